@@ -3,12 +3,14 @@ module github.com/KyleKing/djot-fmt
 go 1.23
 
 require (
+	github.com/mattn/go-runewidth v0.0.16
+	github.com/pmezard/go-difflib v1.0.0
 	github.com/sivukhin/godjot/v2 v2.0.1-0.20250612185934-f0b56981998c
 	github.com/stretchr/testify v1.11.1
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/rivo/uniseg v0.2.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,139 @@
+package formatter
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+
+	"github.com/sivukhin/godjot/v2/djot_parser"
+	"github.com/sivukhin/godjot/v2/djot_tokenizer"
+	"github.com/sivukhin/godjot/v2/tokenizer"
+)
+
+// commentsKey holds the comments written inside a node's attributes,
+// `{.note % TODO %}`, each with its `%` delimiters, separated by spaces.
+const commentsKey = "$Comments"
+
+// commentPlaceholder starts the attribute keys that stand in for comments
+// while the document is parsed; the number after it indexes the comments
+// extractComments returns.
+const commentPlaceholder = "djot-fmt-comment-"
+
+// extractComments replaces every comment inside the attributes of input with
+// a placeholder attribute, so godjot keeps it on the node the attributes
+// belong to. A placeholder is a single line, so a block attribute holding a
+// multi-line comment is still read as one.
+func extractComments(input []byte) ([]byte, []string) {
+	var (
+		output   bytes.Buffer
+		comments []string
+		written  int
+	)
+
+	for _, token := range djot_tokenizer.BuildDjotTokens(input) {
+		if token.Type != djot_tokenizer.Attribute {
+			continue
+		}
+
+		for _, span := range commentSpans(input[token.Start:token.End]) {
+			start, end := token.Start+span[0], token.Start+span[1]
+
+			output.Write(input[written:start])
+			output.WriteString(" " + commentPlaceholder + strconv.Itoa(len(comments)) + `="" `)
+			comments = append(comments, string(input[start:end]))
+			written = end
+		}
+	}
+
+	if comments == nil {
+		return input, nil
+	}
+
+	output.Write(input[written:])
+
+	return output.Bytes(), comments
+}
+
+// commentSpans returns the start and end of each `% ... %` comment in the
+// attribute text, which starts at its opening brace. Like godjot, it ignores
+// `%` inside quoted values.
+func commentSpans(text []byte) [][2]int {
+	var (
+		spans   [][2]int
+		start   = -1
+		quoted  bool
+		escaped bool
+	)
+
+	for i := 1; i < len(text); i++ {
+		c := text[i]
+
+		switch {
+		case start >= 0:
+			if c == '%' {
+				spans = append(spans, [2]int{start, i + 1})
+				start = -1
+			}
+		case quoted:
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				quoted = false
+			}
+		case c == '"':
+			quoted = true
+		case c == '%':
+			start = i
+		case c == '}':
+			return spans
+		}
+	}
+
+	return spans
+}
+
+// isCommentOnly reports whether attrs hold nothing but comment placeholders.
+func isCommentOnly(attrs tokenizer.Attributes) bool {
+	for _, key := range attrs.Keys {
+		if !strings.HasPrefix(key, commentPlaceholder) {
+			return false
+		}
+	}
+
+	return len(attrs.Keys) > 0
+}
+
+// annotateComments turns the placeholders extractComments left in the AST
+// back into the comments they stand for, kept under commentsKey.
+func annotateComments(ast []djot_parser.TreeNode[djot_parser.DjotNode], comments []string) {
+	if len(comments) == 0 {
+		return
+	}
+
+	walkNodes(ast, func(node *djot_parser.TreeNode[djot_parser.DjotNode]) {
+		var (
+			attrs tokenizer.Attributes
+			found []string
+		)
+
+		for _, entry := range node.Attributes.Entries() {
+			index, ok := strings.CutPrefix(entry.Key, commentPlaceholder)
+			if !ok {
+				attrs.Set(entry.Key, entry.Value)
+				continue
+			}
+
+			if k, err := strconv.Atoi(index); err == nil && k < len(comments) {
+				found = append(found, comments[k])
+			}
+		}
+
+		if found != nil {
+			attrs.Set(commentsKey, strings.Join(found, " "))
+			node.Attributes = attrs
+		}
+	})
+}
@@ -0,0 +1,296 @@
+package formatter
+
+import (
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sivukhin/godjot/v2/djot_parser"
+	"github.com/sivukhin/godjot/v2/djot_tokenizer"
+)
+
+// definition is a reference or footnote definition being moved.
+type definition struct {
+	node    djot_parser.TreeNode[djot_parser.DjotNode]
+	key     string
+	name    string // label as written, after renumbering
+	section int    // section the definition is written in
+	source  int    // position among all definitions
+}
+
+// definitionKey identifies what a definition defines: its label, with a `^`
+// in front for footnotes.
+func definitionKey(node djot_parser.TreeNode[djot_parser.DjotNode]) (string, bool) {
+	switch node.Type {
+	case djot_parser.ReferenceDefNode:
+		return node.Attributes.Get(djot_tokenizer.ReferenceKey), true
+	case djot_parser.FootnoteDefNode:
+		return "^" + node.Attributes.Get(djot_tokenizer.ReferenceKey), true
+	default:
+		return "", false
+	}
+}
+
+// useKey returns the key of the definition a link or footnote reference uses.
+func useKey(node djot_parser.TreeNode[djot_parser.DjotNode]) (string, bool) {
+	if label, ok := node.Attributes.TryGet(footnoteLabelKey); ok {
+		return "^" + label, true
+	}
+
+	if label, ok := node.Attributes.TryGet(linkReferenceKey); ok {
+		return referenceLabel(node, label), true
+	}
+
+	return "", false
+}
+
+// relocateDefinitions returns the AST with its reference and footnote
+// definitions moved to the end of the document or of the section first using
+// them, as opts asks. Sections start at every heading, whatever its level.
+func relocateDefinitions(
+	ast []djot_parser.TreeNode[djot_parser.DjotNode],
+	opts *Options,
+	footnoteLabel func(string) string,
+) []djot_parser.TreeNode[djot_parser.DjotNode] {
+	if opts.DefinitionPlacement == DefinitionPlacementPreserve || opts.DefinitionPlacement == "" ||
+		len(ast) != 1 || ast[0].Type != djot_parser.DocumentNode {
+		return ast
+	}
+
+	type use struct{ section, order int }
+
+	var (
+		document = ast[0]
+		defs     []definition
+		uses     = map[string]use{}
+		section  = 0
+	)
+
+	recordUses := func(nodes []djot_parser.TreeNode[djot_parser.DjotNode]) {
+		walkNodes(nodes, func(node *djot_parser.TreeNode[djot_parser.DjotNode]) {
+			if key, ok := useKey(*node); ok {
+				if _, seen := uses[key]; !seen {
+					uses[key] = use{section: section, order: len(uses)}
+				}
+			}
+		})
+	}
+
+	visitTopLevel(&document.Children, func(node *djot_parser.TreeNode[djot_parser.DjotNode]) ([]djot_parser.TreeNode[djot_parser.DjotNode], bool) {
+		if node.Type == djot_parser.HeadingNode {
+			section++
+		}
+
+		if node.Type == djot_parser.TableNode {
+			// the blocks after the table are visited on their own
+			recordUses(slices.DeleteFunc(slices.Clone(node.Children), func(child djot_parser.TreeNode[djot_parser.DjotNode]) bool {
+				return !isTablePart(child)
+			}))
+
+			return nil, true
+		}
+
+		recordUses(node.Children)
+
+		if key, ok := definitionKey(*node); ok {
+			name := key
+			if node.Type == djot_parser.FootnoteDefNode {
+				name = "^" + footnoteLabel(node.Attributes.Get(djot_tokenizer.ReferenceKey))
+			}
+
+			defs = append(defs, definition{node: *node, key: key, name: name, section: section, source: len(defs)})
+			return nil, false
+		}
+
+		return nil, true
+	})
+
+	if len(defs) == 0 {
+		return ast
+	}
+
+	targets := map[int][]definition{}
+
+	for _, def := range uniqueDefinitions(defs) {
+		target := section + 1 // after the last section
+
+		if opts.DefinitionPlacement == DefinitionPlacementSection {
+			target = def.section
+			if first, ok := uses[def.key]; ok {
+				target = first.section
+			}
+		}
+
+		targets[target] = append(targets[target], def)
+	}
+
+	for _, group := range targets {
+		sort.SliceStable(group, func(a, b int) bool {
+			return definitionLess(group[a], group[b], opts.DefinitionOrder, func(key string) (int, bool) {
+				first, ok := uses[key]
+				return first.order, ok
+			})
+		})
+	}
+
+	nodes := func(group []definition) []djot_parser.TreeNode[djot_parser.DjotNode] {
+		result := make([]djot_parser.TreeNode[djot_parser.DjotNode], len(group))
+		for i, def := range group {
+			result[i] = def.node
+		}
+
+		return result
+	}
+
+	section = 0
+
+	visitTopLevel(&document.Children, func(node *djot_parser.TreeNode[djot_parser.DjotNode]) ([]djot_parser.TreeNode[djot_parser.DjotNode], bool) {
+		if node.Type != djot_parser.HeadingNode {
+			return nil, true
+		}
+
+		section++
+
+		return nodes(targets[section-1]), true
+	})
+
+	document.Children = append(document.Children, nodes(targets[section])...)
+	document.Children = append(document.Children, nodes(targets[section+1])...)
+
+	return []djot_parser.TreeNode[djot_parser.DjotNode]{document}
+}
+
+// definitionLess orders moved definitions: reference definitions before
+// footnotes, then by order, then as they were written. firstUse returns when
+// a key is first used; definitions nothing uses go last.
+func definitionLess(a, b definition, order DefinitionOrder, firstUse func(string) (int, bool)) bool {
+	aFootnote, bFootnote := a.node.Type == djot_parser.FootnoteDefNode, b.node.Type == djot_parser.FootnoteDefNode
+	if aFootnote != bFootnote {
+		return bFootnote
+	}
+
+	switch order {
+	case DefinitionOrderAlphabetical:
+		if a.name != b.name {
+			return labelLess(a.name, b.name)
+		}
+	case DefinitionOrderFirstUse:
+		aUse, aUsed := firstUse(a.key)
+		bUse, bUsed := firstUse(b.key)
+
+		switch {
+		case aUsed && bUsed && aUse != bUse:
+			return aUse < bUse
+		case aUsed != bUsed:
+			return aUsed
+		}
+	}
+
+	return a.source < b.source
+}
+
+// labelLess compares labels alphabetically, except that numeric labels
+// compare by value, so `[^2]` sorts before `[^10]`.
+func labelLess(a, b string) bool {
+	aNumber, bNumber := strings.TrimPrefix(a, "^"), strings.TrimPrefix(b, "^")
+	if len(a)-len(aNumber) == len(b)-len(bNumber) && isNumericLabel(aNumber) && isNumericLabel(bNumber) {
+		aNumber, bNumber = strings.TrimLeft(aNumber, "0"), strings.TrimLeft(bNumber, "0")
+		if len(aNumber) != len(bNumber) {
+			return len(aNumber) < len(bNumber)
+		}
+	}
+
+	return a < b
+}
+
+// uniqueDefinitions drops definitions that repeat an earlier one exactly.
+// Conflicting definitions of the same label are all kept; DuplicateDefinitions
+// reports them.
+func uniqueDefinitions(defs []definition) []definition {
+	var unique []definition
+
+	for _, def := range defs {
+		if !slices.ContainsFunc(unique, func(kept definition) bool {
+			return kept.key == def.key && sameDefinition(kept.node, def.node)
+		}) {
+			unique = append(unique, def)
+		}
+	}
+
+	return unique
+}
+
+func sameDefinition(a, b djot_parser.TreeNode[djot_parser.DjotNode]) bool {
+	if a.Type == djot_parser.ReferenceDefNode {
+		return a.Attributes.Get(djot_parser.LinkHrefKey) == b.Attributes.Get(djot_parser.LinkHrefKey)
+	}
+
+	return reflect.DeepEqual(a.Children, b.Children)
+}
+
+// DuplicateDefinitions returns the labels of references and footnotes that
+// are defined more than once in the AST, written as `[label]` and `[^label]`.
+func DuplicateDefinitions(ast []djot_parser.TreeNode[djot_parser.DjotNode]) []string {
+	var (
+		duplicates []string
+		count      = map[string]int{}
+	)
+
+	walkNodes(ast, func(node *djot_parser.TreeNode[djot_parser.DjotNode]) {
+		key, ok := definitionKey(*node)
+		if !ok {
+			return
+		}
+
+		count[key]++
+		if count[key] == 2 {
+			duplicates = append(duplicates, "["+key+"]")
+		}
+	})
+
+	return duplicates
+}
+
+// footnoteNumbers maps each numeric footnote label to its number in order of
+// first reference, counting definitions nothing refers to after the rest.
+// Named labels are left out, so they keep their name.
+func footnoteNumbers(ast []djot_parser.TreeNode[djot_parser.DjotNode]) map[string]string {
+	var (
+		numbers = map[string]string{}
+		defined []string
+	)
+
+	number := func(label string) {
+		if _, seen := numbers[label]; !seen && isNumericLabel(label) {
+			numbers[label] = strconv.Itoa(len(numbers) + 1)
+		}
+	}
+
+	walkNodes(ast, func(node *djot_parser.TreeNode[djot_parser.DjotNode]) {
+		if label, ok := node.Attributes.TryGet(footnoteLabelKey); ok {
+			number(label)
+		}
+
+		if node.Type == djot_parser.FootnoteDefNode {
+			defined = append(defined, node.Attributes.Get(djot_tokenizer.ReferenceKey))
+		}
+	})
+
+	for _, label := range defined {
+		number(label)
+	}
+
+	return numbers
+}
+
+func isNumericLabel(label string) bool {
+	for _, c := range label {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return label != ""
+}
@@ -0,0 +1,212 @@
+package formatter
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/KyleKing/djot-fmt/internal/slw"
+	"github.com/sivukhin/godjot/v2/djot_parser"
+)
+
+// startOfLine stands in for the previous character at the start of a line.
+const startOfLine rune = 0
+
+// isEscaped reports whether a text node must be written with a backslash
+// escape, because djot would otherwise read its literal punctuation character
+// as markup. godjot turns each escape into its own single-character text node,
+// so only those are candidates; longer text was already literal where it stood.
+func isEscaped(state djot_parser.ConversionState[*Writer]) bool {
+	text := state.Node.Text
+	if len(text) != 1 || !isASCIIPunctuation(text[0]) || inVerbatim(state) {
+		return false
+	}
+
+	if text[0] == '(' && state.Writer.lastRune() == startOfLine {
+		// only an ordered list marker such as `(a) `, by the same rule line
+		// wrapping uses, so a `(` wrapped to the start of a line stays as is
+		return slw.StartsBlock("(" + nextText(state))
+	}
+
+	return needsEscape(text[0], state.Writer.lastRune(), nextRune(state))
+}
+
+// needsEscape reports whether the literal character c, written between prev
+// and next, would be read as djot syntax. prev is startOfLine at the start of a
+// line and next is a space at the end of a block.
+func needsEscape(c byte, prev, next rune) bool {
+	if prev == startOfLine && strings.IndexByte("-+*>:#|", c) >= 0 {
+		// block markers such as `- `, `> ` or `# `
+		return true
+	}
+
+	switch c {
+	case '*', '_', '^', '~':
+		// a delimiter can open before a non-space or close after one
+		return !isSpaceOrStart(prev) || !unicode.IsSpace(next)
+	case '-', '.':
+		// smart punctuation: `--` dashes and `...` ellipses
+		if prev == rune(c) || next == rune(c) {
+			return true
+		}
+
+		return c == '.' && isEnumerator(prev) && unicode.IsSpace(next)
+	case ')':
+		return isEnumerator(prev) && unicode.IsSpace(next)
+	case '!':
+		return next == '['
+	case '$':
+		return next == '`'
+	case ':':
+		// symbols such as `:smile:`
+		return next != ' ' && !unicode.IsSpace(next)
+	case '\\', '`', '[', ']', '{', '}', '<', '|', '"', '\'':
+		return true
+	default:
+		return false
+	}
+}
+
+// nextRune returns the first character written after the current node: a
+// space when it is the last node of its block, or `}` when it ends an inline
+// container.
+func nextRune(state djot_parser.ConversionState[*Writer]) rune {
+	if state.Parent == nil {
+		return ' '
+	}
+
+	siblings := state.Parent.Children
+	for i := range siblings {
+		if !sameNode(siblings[i], state.Node) {
+			continue
+		}
+
+		if i+1 < len(siblings) {
+			return firstRune(siblings[i+1])
+		}
+
+		if isInlineNode(*state.Parent) {
+			// the parent's closing delimiter follows
+			return '}'
+		}
+
+		return ' '
+	}
+
+	return ' '
+}
+
+// nextText returns the text of the node written after the current one, or
+// nothing when that is not a text node.
+func nextText(state djot_parser.ConversionState[*Writer]) string {
+	if state.Parent == nil {
+		return ""
+	}
+
+	siblings := state.Parent.Children
+	for i := range siblings {
+		if sameNode(siblings[i], state.Node) && i+1 < len(siblings) && siblings[i+1].Type == djot_parser.TextNode {
+			return string(siblings[i+1].Text)
+		}
+	}
+
+	return ""
+}
+
+// sameNode reports whether a and b are the same node. godjot slices text out
+// of the source document and conversions get copies of nodes, so the backing
+// arrays of the text or children identify a node.
+func sameNode(a, b djot_parser.TreeNode[djot_parser.DjotNode]) bool {
+	switch {
+	case a.Type != b.Type:
+		return false
+	case len(a.Text) > 0 && len(b.Text) > 0:
+		return &a.Text[0] == &b.Text[0]
+	case len(a.Children) > 0 && len(b.Children) > 0:
+		return &a.Children[0] == &b.Children[0]
+	default:
+		return false
+	}
+}
+
+// firstRune returns the first character the formatter writes for an inline node.
+func firstRune(node djot_parser.TreeNode[djot_parser.DjotNode]) rune {
+	switch node.Type {
+	case djot_parser.TextNode:
+		if r, _ := utf8.DecodeRune(node.Text); r != utf8.RuneError {
+			return r
+		}
+
+		return ' '
+	case djot_parser.LineBreakNode:
+		return '\\'
+	case djot_parser.EmphasisNode:
+		return '_'
+	case djot_parser.StrongNode:
+		return '*'
+	case djot_parser.LinkNode:
+		if _, ok := node.Attributes.TryGet(autolinkKey); ok {
+			return '<'
+		}
+
+		return '['
+	case djot_parser.SpanNode:
+		return '['
+	case djot_parser.ImageNode:
+		return '!'
+	case djot_parser.VerbatimNode:
+		return '`'
+	case djot_parser.SymbolsNode:
+		return ':'
+	default:
+		return '{'
+	}
+}
+
+// finalRune returns the last character the formatter writes for an inline node.
+func finalRune(node djot_parser.TreeNode[djot_parser.DjotNode]) rune {
+	switch node.Type {
+	case djot_parser.TextNode:
+		if r, _ := utf8.DecodeLastRune(node.Text); r != utf8.RuneError {
+			return r
+		}
+
+		return ' '
+	case djot_parser.LineBreakNode:
+		return '\n'
+	case djot_parser.EmphasisNode:
+		return '_'
+	case djot_parser.StrongNode:
+		return '*'
+	case djot_parser.LinkNode:
+		if _, ok := node.Attributes.TryGet(autolinkKey); ok {
+			return '>'
+		}
+
+		return ')'
+	case djot_parser.VerbatimNode:
+		return '`'
+	case djot_parser.SymbolsNode:
+		return ':'
+	default:
+		return '}'
+	}
+}
+
+func inVerbatim(state djot_parser.ConversionState[*Writer]) bool {
+	return state.Parent != nil && state.Parent.Type == djot_parser.VerbatimNode
+}
+
+func isSpaceOrStart(r rune) bool {
+	return r == startOfLine || unicode.IsSpace(r)
+}
+
+// isEnumerator reports whether r could end an ordered list number such as
+// `1.` or `a)`.
+func isEnumerator(r rune) bool {
+	return r < utf8.RuneSelf && (unicode.IsDigit(r) || unicode.IsLetter(r))
+}
+
+func isASCIIPunctuation(c byte) bool {
+	return c < utf8.RuneSelf && unicode.IsPunct(rune(c)) || strings.IndexByte("$+<=>^`|~", c) >= 0
+}
@@ -1,7 +1,9 @@
 package formatter
 
 import (
+	"strconv"
 	"strings"
+	"unicode"
 
 	"github.com/KyleKing/djot-fmt/internal/slw"
 	"github.com/sivukhin/godjot/v2/djot_parser"
@@ -9,8 +11,13 @@ import (
 	"github.com/sivukhin/godjot/v2/tokenizer"
 )
 
-func formatDocument(_ djot_parser.ConversionState[*Writer], next func(djot_parser.Children)) {
+func formatDocument(state djot_parser.ConversionState[*Writer], next func(djot_parser.Children)) {
 	next(nil)
+
+	// definitions for links switched to reference style
+	for _, def := range state.Writer.references.added {
+		writeReferenceDef(state.Writer, def.label, def.url)
+	}
 }
 
 func formatSection(_ djot_parser.ConversionState[*Writer], next func(djot_parser.Children)) {
@@ -18,158 +25,205 @@ func formatSection(_ djot_parser.ConversionState[*Writer], next func(djot_parser
 }
 
 func formatText(state djot_parser.ConversionState[*Writer], _ func(djot_parser.Children)) {
-	text := string(state.Node.Text)
+	if isEscaped(state) {
+		// an escape is never a sentence end or a place to break a line
+		state.Writer.writeAtom("\\" + string(state.Node.Text))
+		return
+	}
 
-	if state.Writer.InParagraph() && state.Writer.slwConfig != nil && state.Writer.slwConfig.Enabled {
-		text = slw.WrapText(text, state.Writer.slwConfig)
+	if state.Writer.options.AutolinkURLs && !state.Writer.inLink && !inVerbatim(state) {
+		writeAutolinked(state.Writer, string(state.Node.Text))
+		return
 	}
 
-	state.Writer.WriteString(text)
+	state.Writer.WriteString(string(state.Node.Text))
 }
 
 func formatParagraph(state djot_parser.ConversionState[*Writer], next func(djot_parser.Children)) {
 	w := state.Writer
 
+	if len(state.Node.Children) == 0 {
+		// attributes on a line of their own, such as a standalone comment; a
+		// line holding only a marker or `>` would be lost on the next run
+		if attrs := formatAttributes(state.Node.Attributes); attrs != "" {
+			if w.NeedsBlankLine() {
+				w.WriteString("\n")
+			}
+
+			w.WriteString(attrs + "\n")
+			w.SetLastBlockType(BlockTypeParagraph)
+		}
+
+		return
+	}
+
 	if w.NeedsBlankLine() {
 		w.WriteString("\n")
 	}
 
-	w.SetInParagraph(true)
-	next(nil)
-	w.SetInParagraph(false)
+	writeBlockAttributes(w, state.Node.Attributes)
+
+	if isDisplayMath(state.Node) {
+		// a block of its own: written as is, never wrapped or joined
+		next(nil)
+	} else {
+		w.wrapInline(func() { next(nil) })
+	}
 
 	w.WriteString("\n")
 	w.SetLastBlockType(BlockTypeParagraph)
 }
 
-func formatList(state djot_parser.ConversionState[*Writer], next func(djot_parser.Children)) {
-	w := state.Writer
+func formatEmphasis(state djot_parser.ConversionState[*Writer], next func(djot_parser.Children)) {
+	formatDelimited(state, next, "_")
+}
 
-	if w.InListItem() {
-		w.WriteString("\n")
-	} else if w.NeedsBlankLine() {
-		w.WriteString("\n")
+func formatStrong(state djot_parser.ConversionState[*Writer], next func(djot_parser.Children)) {
+	formatDelimited(state, next, "*")
+}
+
+// formatDelimited writes emphasis or strong with delim, using the braced form
+// `{_..._}` where a bare delimiter would not be read as one: next to a letter
+// or digit outside, or next to whitespace inside.
+func formatDelimited(state djot_parser.ConversionState[*Writer], next func(djot_parser.Children), delim string) {
+	open, closing := delim, delim
+	if needsBraces(state) {
+		open, closing = "{"+delim, delim+"}"
 	}
 
-	_, isSparse := state.Node.Attributes.TryGet(djot_parser.SparseListNodeKey)
-	w.SetInSparseList(isSparse)
+	state.Writer.WriteString(open)
 	next(nil)
-	w.SetInSparseList(false)
-
-	w.SetLastBlockType(BlockTypeList)
+	state.Writer.WriteString(closing)
+	state.Writer.writeAtom(formatAttributes(state.Node.Attributes))
 }
 
-func formatListItem(state djot_parser.ConversionState[*Writer], next func(djot_parser.Children)) {
-	w := state.Writer
+func needsBraces(state djot_parser.ConversionState[*Writer]) bool {
+	children := state.Node.Children
+	if len(children) == 0 {
+		return true
+	}
 
-	marker := "- "
+	return isAlphanumeric(state.Writer.lastRune()) || isAlphanumeric(nextRune(state)) ||
+		unicode.IsSpace(firstRune(children[0])) || unicode.IsSpace(finalRune(children[len(children)-1]))
+}
 
-	if state.Parent != nil {
-		switch state.Parent.Type {
-		case djot_parser.OrderedListNode:
-			listStyle := state.Parent.Attributes.Get("type")
-			if listStyle == "" {
-				listStyle = "1"
-			}
+func isAlphanumeric(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
 
-			marker = listStyle + ". "
-		case djot_parser.TaskListNode:
-			class := state.Node.Attributes.Get("class")
-			if class == "checked" {
-				marker = "- [x] "
-			} else {
-				marker = "- [ ] "
-			}
-		}
+func formatLink(state djot_parser.ConversionState[*Writer], next func(djot_parser.Children)) {
+	if label, ok := state.Node.Attributes.TryGet(footnoteLabelKey); ok {
+		state.Writer.writeAtom("[^" + state.Writer.footnoteLabel(label) + "]")
+		return
 	}
 
-	w.WriteIndent().WriteString(marker)
-
-	indent := strings.Repeat(" ", len(marker))
-	w.PushIndent(indent)
-	w.SetInListItem(true)
+	if text, ok := state.Node.Attributes.TryGet(autolinkKey); ok {
+		state.Writer.writeAtom("<" + text + ">" + formatAttributes(state.Node.Attributes))
+		return
+	}
 
-	previousBlockType := w.GetLastBlockType()
-	w.SetLastBlockType(BlockTypeNone)
+	url := state.Node.Attributes.Get(djot_parser.LinkHrefKey)
+	label, isReference := linkReference(state.Writer, state.Node, url)
 
-	next(nil)
+	state.Writer.atomic(func() {
+		state.Writer.WriteString("[")
 
-	if w.InSparseList() {
-		w.WriteString("\n")
-	}
+		state.Writer.inLink = true
+		next(nil)
+		state.Writer.inLink = false
 
-	w.SetLastBlockType(previousBlockType)
-	w.PopIndent()
-	w.SetInListItem(false)
-}
+		if isReference {
+			state.Writer.WriteString("][" + label + "]")
+		} else {
+			state.Writer.WriteString("](" + url + ")")
+		}
 
-func formatEmphasis(state djot_parser.ConversionState[*Writer], next func(djot_parser.Children)) {
-	state.Writer.WriteString("_")
-	next(nil)
-	state.Writer.WriteString("_")
-	state.Writer.WriteString(formatAttributes(state.Node.Attributes))
+		state.Writer.WriteString(formatAttributes(state.Node.Attributes))
+	})
 }
 
-func formatStrong(state djot_parser.ConversionState[*Writer], next func(djot_parser.Children)) {
-	state.Writer.WriteString("*")
-	next(nil)
-	state.Writer.WriteString("*")
-	state.Writer.WriteString(formatAttributes(state.Node.Attributes))
+func formatVerbatim(state djot_parser.ConversionState[*Writer], next func(djot_parser.Children)) {
+	state.Writer.verbatim(func() { formatVerbatimContent(state, next) })
 }
 
-func formatLink(state djot_parser.ConversionState[*Writer], next func(djot_parser.Children)) {
-	url := state.Node.Attributes.Get(djot_parser.LinkHrefKey)
-	state.Writer.WriteString("[")
-	next(nil)
-	state.Writer.WriteString("](" + url + ")")
-	state.Writer.WriteString(formatAttributes(state.Node.Attributes))
-}
+func formatVerbatimContent(state djot_parser.ConversionState[*Writer], _ func(djot_parser.Children)) {
+	w := state.Writer
+	content := extractTextContent(state.Node)
 
-func formatVerbatim(state djot_parser.ConversionState[*Writer], next func(djot_parser.Children)) {
+	// math is verbatim text marked with `$` (inline) or `$$` (display)
+	math := ""
 	if _, ok := state.Node.Attributes.TryGet(djot_tokenizer.InlineMathKey); ok {
-		state.Writer.WriteString("$")
-		next(nil)
-		state.Writer.WriteString("$")
+		math = "$"
+	} else if _, ok := state.Node.Attributes.TryGet(djot_tokenizer.DisplayMathKey); ok {
+		math = "$$"
+	}
 
-		return
+	if math != "" && w.options.NormalizeMath {
+		content = strings.Join(strings.Fields(content), " ")
 	}
 
-	if _, ok := state.Node.Attributes.TryGet(djot_tokenizer.DisplayMathKey); ok {
-		state.Writer.WriteString("$$")
-		next(nil)
-		state.Writer.WriteString("$$")
+	delimiter, needsSpaces := verbatimDelimiter(content)
 
-		return
+	w.WriteString(math + delimiter)
+
+	if needsSpaces {
+		w.WriteString(" ")
 	}
 
-	content := extractTextContent(state.Node)
+	w.WriteString(content)
+
+	if needsSpaces {
+		w.WriteString(" ")
+	}
+
+	w.WriteString(delimiter)
+
+	if format, ok := state.Node.Attributes.TryGet(djot_parser.RawInlineFormatKey); ok {
+		w.WriteString("{=" + format + "}")
+	}
 
-	delimiter := "`"
-	needsSpaces := false
+	w.WriteString(formatAttributes(state.Node.Attributes))
+}
 
-	if strings.Contains(content, "`") {
-		if strings.Contains(content, "``") {
-			delimiter = "```"
+// verbatimDelimiter returns the backticks around verbatim content: one more
+// than its longest run of backticks. Content starting or ending with a
+// backtick is padded with spaces so it does not run into the delimiter.
+func verbatimDelimiter(content string) (string, bool) {
+	longest, run := 0, 0
+
+	for _, c := range content {
+		if c == '`' {
+			run++
+			longest = max(longest, run)
 		} else {
-			delimiter = "``"
+			run = 0
 		}
-
-		needsSpaces = strings.HasPrefix(content, "`") || strings.HasSuffix(content, "`")
 	}
 
-	state.Writer.WriteString(delimiter)
+	needsSpaces := strings.HasPrefix(content, "`") || strings.HasSuffix(content, "`")
 
-	if needsSpaces {
-		state.Writer.WriteString(" ")
-	}
+	return strings.Repeat("`", longest+1), needsSpaces
+}
 
-	next(nil)
+// isDisplayMath reports whether paragraph holds nothing but display math.
+func isDisplayMath(paragraph djot_parser.TreeNode[djot_parser.DjotNode]) bool {
+	found := false
 
-	if needsSpaces {
-		state.Writer.WriteString(" ")
+	for _, child := range paragraph.Children {
+		switch {
+		case child.Type == djot_parser.VerbatimNode && !found:
+			if _, ok := child.Attributes.TryGet(djot_tokenizer.DisplayMathKey); !ok {
+				return false
+			}
+
+			found = true
+		case child.Type == djot_parser.TextNode && strings.TrimSpace(string(child.Text)) == "":
+		default:
+			return false
+		}
 	}
 
-	state.Writer.WriteString(delimiter)
+	return found
 }
 
 func makeInlineFormatter(openDelim, closeDelim string) djot_parser.Conversion[*Writer] {
@@ -177,26 +231,52 @@ func makeInlineFormatter(openDelim, closeDelim string) djot_parser.Conversion[*W
 		state.Writer.WriteString(openDelim)
 		next(nil)
 		state.Writer.WriteString(closeDelim)
-		state.Writer.WriteString(formatAttributes(state.Node.Attributes))
+		state.Writer.writeAtom(formatAttributes(state.Node.Attributes))
 	}
 }
 
 func formatLineBreak(state djot_parser.ConversionState[*Writer], _ func(djot_parser.Children)) {
-	state.Writer.WriteString("\\\n")
+	// kept verbatim so reflowing never joins a hard line break
+	state.Writer.verbatim(func() { state.Writer.WriteString("\\\n") })
 }
 
-func formatImage(state djot_parser.ConversionState[*Writer], _ func(djot_parser.Children)) {
-	alt := state.Node.Attributes.Get(djot_parser.ImgAltKey)
+func formatImage(state djot_parser.ConversionState[*Writer], next func(djot_parser.Children)) {
+	w := state.Writer
 	src := state.Node.Attributes.Get(djot_parser.ImgSrcKey)
-	state.Writer.WriteString("![" + alt + "](" + src + ")")
-	state.Writer.WriteString(formatAttributes(state.Node.Attributes))
+
+	target := "(" + src + ")"
+	if label, isReference := linkReference(w, state.Node, src); isReference {
+		target = "[" + label + "]"
+	}
+
+	w.atomic(func() {
+		w.WriteString("![")
+
+		if len(state.Node.Children) > 0 {
+			w.inLink = true
+			next(nil)
+			w.inLink = false
+		} else {
+			w.WriteString(state.Node.Attributes.Get(djot_parser.ImgAltKey))
+		}
+
+		w.WriteString("]" + target + formatAttributes(state.Node.Attributes))
+	})
 }
 
 func formatSpan(state djot_parser.ConversionState[*Writer], next func(djot_parser.Children)) {
+	if children := state.Node.Children; len(children) == 1 && children[0].Type == djot_parser.TextNode &&
+		len(children[0].Text) == 0 {
+		// bare attributes after a space, `text {% comment %}`, which godjot
+		// reads as an empty span
+		state.Writer.writeAtom(formatAttributes(state.Node.Attributes))
+		return
+	}
+
 	state.Writer.WriteString("[")
 	next(nil)
 	state.Writer.WriteString("]")
-	state.Writer.WriteString(formatAttributes(state.Node.Attributes))
+	state.Writer.writeAtom(formatAttributes(state.Node.Attributes))
 }
 
 func formatSymbols(state djot_parser.ConversionState[*Writer], next func(djot_parser.Children)) {
@@ -212,6 +292,7 @@ func formatThematicBreak(state djot_parser.ConversionState[*Writer], _ func(djot
 		w.WriteString("\n")
 	}
 
+	writeBlockAttributes(w, state.Node.Attributes)
 	w.WriteString("***\n")
 	w.SetLastBlockType(BlockTypeParagraph)
 }
@@ -224,14 +305,16 @@ func formatCode(state djot_parser.ConversionState[*Writer], next func(djot_parse
 	}
 
 	class := state.Node.Attributes.Get("class")
+	content := codeContent(state.Node)
+	fence := codeFence(state.Node, content)
 
 	if hasNonClassAttributes(state.Node.Attributes) {
 		attrs := formatAttributes(state.Node.Attributes)
 		w.WriteString(attrs)
 		w.WriteString("\n")
-		w.WriteString("```\n")
+		w.WriteString(fence + "\n")
 	} else {
-		w.WriteString("```")
+		w.WriteString(fence)
 
 		if lang, ok := strings.CutPrefix(class, "language-"); ok {
 			w.WriteString(lang)
@@ -240,9 +323,8 @@ func formatCode(state djot_parser.ConversionState[*Writer], next func(djot_parse
 		w.WriteString("\n")
 	}
 
-	next(nil)
-
-	w.WriteString("```\n")
+	w.WriteString(content)
+	w.WriteString(fence + "\n")
 	w.SetLastBlockType(BlockTypeParagraph)
 }
 
@@ -254,15 +336,50 @@ func formatRaw(state djot_parser.ConversionState[*Writer], next func(djot_parser
 	}
 
 	format := state.Node.Attributes.Get(djot_parser.RawBlockFormatKey)
+	content := codeContent(state.Node)
+	fence := codeFence(state.Node, content)
 
-	w.WriteString("```=")
+	w.WriteString(fence + "=")
 	w.WriteString(format)
 	w.WriteString("\n")
+	w.WriteString(content)
+	w.WriteString(fence + "\n")
+	w.SetLastBlockType(BlockTypeParagraph)
+}
 
-	next(nil)
+// codeContent returns the content of a code or raw block with the indentation
+// of its fence removed from every line.
+func codeContent(node djot_parser.TreeNode[djot_parser.DjotNode]) string {
+	content := extractTextContent(node)
 
-	w.WriteString("```\n")
-	w.SetLastBlockType(BlockTypeParagraph)
+	indent, err := strconv.Atoi(node.Attributes.Get(codeIndentKey))
+	if err != nil || indent == 0 {
+		return content
+	}
+
+	lines := strings.SplitAfter(content, "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimLeft(line, " ")
+		lines[i] = line[min(len(line)-len(trimmed), indent):]
+	}
+
+	return strings.Join(lines, "")
+}
+
+// codeFence returns the backticks fencing a code or raw block: more than start
+// any line of its content, and no fewer than it was written with.
+func codeFence(node djot_parser.TreeNode[djot_parser.DjotNode], content string) string {
+	length := 3
+	if written, err := strconv.Atoi(node.Attributes.Get(codeFenceKey)); err == nil {
+		length = max(length, written)
+	}
+
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimLeft(line, " \t")
+		length = max(length, len(line)-len(strings.TrimLeft(line, "`"))+1)
+	}
+
+	return strings.Repeat("`", length)
 }
 
 func formatQuote(state djot_parser.ConversionState[*Writer], next func(djot_parser.Children)) {
@@ -272,19 +389,18 @@ func formatQuote(state djot_parser.ConversionState[*Writer], next func(djot_pars
 		w.WriteString("\n")
 	}
 
-	attrs := formatAttributes(state.Node.Attributes)
-	if attrs != "" {
-		w.WriteString(attrs)
-		w.WriteString("\n")
-	}
-
+	writeBlockAttributes(w, state.Node.Attributes)
 	w.PushLinePrefix("> ")
 
+	wasInListItem := w.InListItem()
+	w.SetInListItem(false)
+
 	previousBlockType := w.GetLastBlockType()
 	w.SetLastBlockType(BlockTypeNone)
 	next(nil)
 	w.SetLastBlockType(previousBlockType)
 
+	w.SetInListItem(wasInListItem)
 	w.PopLinePrefix()
 
 	w.SetLastBlockType(BlockTypeParagraph)
@@ -298,14 +414,15 @@ func formatDiv(state djot_parser.ConversionState[*Writer], next func(djot_parser
 	}
 
 	class := state.Node.Attributes.Get("class")
+	fence := strings.Repeat(":", divFenceLength(state.Node))
 
 	if hasNonClassAttributes(state.Node.Attributes) {
 		attrs := formatAttributes(state.Node.Attributes)
 		w.WriteString(attrs)
 		w.WriteString("\n")
-		w.WriteString(":::\n")
+		w.WriteString(fence + "\n")
 	} else {
-		w.WriteString(":::")
+		w.WriteString(fence)
 
 		if class != "" {
 			w.WriteString(" ")
@@ -315,63 +432,112 @@ func formatDiv(state djot_parser.ConversionState[*Writer], next func(djot_parser
 		w.WriteString("\n")
 	}
 
+	wasInListItem := w.InListItem()
+	w.SetInListItem(false)
+
 	previousBlockType := w.GetLastBlockType()
 	w.SetLastBlockType(BlockTypeNone)
 	next(nil)
 	w.SetLastBlockType(previousBlockType)
 
-	w.WriteString(":::\n")
+	w.SetInListItem(wasInListItem)
+	w.WriteString(fence + "\n")
 	w.SetLastBlockType(BlockTypeParagraph)
 }
 
+// divFenceLength returns the number of colons fencing a div: more than any div
+// nested in it uses, so an inner fence never closes it, and no fewer than it
+// was written with.
+func divFenceLength(node djot_parser.TreeNode[djot_parser.DjotNode]) int {
+	length := 3
+	if written, err := strconv.Atoi(node.Attributes.Get(divFenceKey)); err == nil {
+		length = max(length, written)
+	}
+
+	var visit func(nodes []djot_parser.TreeNode[djot_parser.DjotNode])
+
+	visit = func(nodes []djot_parser.TreeNode[djot_parser.DjotNode]) {
+		for _, child := range nodes {
+			if child.Type == djot_parser.DivNode {
+				length = max(length, divFenceLength(child)+1)
+			} else {
+				visit(child.Children)
+			}
+		}
+	}
+
+	visit(node.Children)
+
+	return length
+}
+
 func formatDefinitionList(state djot_parser.ConversionState[*Writer], next func(djot_parser.Children)) {
 	w := state.Writer
 
-	if w.NeedsBlankLine() {
+	if w.InListItem() && !w.markerPending() {
+		w.WriteString("\n")
+	} else if w.NeedsBlankLine() {
 		w.WriteString("\n")
 	}
 
+	_, isSparse := state.Node.Attributes.TryGet(djot_parser.SparseListNodeKey)
+	wasSparse := w.InSparseList()
+	w.SetInSparseList(isSparse)
+	w.SetLastBlockType(BlockTypeNone)
 	next(nil)
+	w.SetInSparseList(wasSparse)
+
 	w.SetLastBlockType(BlockTypeParagraph)
 }
 
+// formatDefinitionTerm writes a term as `: term`. Loose items are separated by
+// blank lines, like the items of other lists.
 func formatDefinitionTerm(state djot_parser.ConversionState[*Writer], next func(djot_parser.Children)) {
 	w := state.Writer
 
-	next(nil)
+	if w.InSparseList() && w.GetLastBlockType() != BlockTypeNone {
+		w.WriteString("\n")
+	}
+
+	w.PushListMarker(": ", "  ")
+	w.wrapInline(func() { next(nil) })
 	w.WriteString("\n")
+	w.PopIndent()
+
+	w.SetLastBlockType(BlockTypeParagraph)
 }
 
+// formatDefinitionItem writes the blocks defining a term, indented under it
+// after a blank line.
 func formatDefinitionItem(state djot_parser.ConversionState[*Writer], next func(djot_parser.Children)) {
 	w := state.Writer
 
-	w.WriteString(": ")
-	w.IncreaseIndent()
+	if len(state.Node.Children) == 0 {
+		return
+	}
 
-	previousBlockType := w.GetLastBlockType()
-	w.SetLastBlockType(BlockTypeNone)
+	wasInListItem := w.InListItem()
+	w.SetInListItem(false)
+	w.PushIndent("  ")
 	next(nil)
-	w.SetLastBlockType(previousBlockType)
+	w.PopIndent()
+	w.SetInListItem(wasInListItem)
 
-	w.DecreaseIndent()
+	w.SetLastBlockType(BlockTypeParagraph)
 }
 
 func formatReferenceDef(state djot_parser.ConversionState[*Writer], _ func(djot_parser.Children)) {
 	w := state.Writer
-
-	if w.NeedsBlankLine() {
-		w.WriteString("\n")
-	}
-
 	label := state.Node.Attributes.Get(djot_tokenizer.ReferenceKey)
+
 	url := state.Node.Attributes.Get(djot_parser.LinkHrefKey)
 
-	w.WriteString("[")
-	w.WriteString(label)
-	w.WriteString("]: ")
-	w.WriteString(url)
-	w.WriteString("\n")
-	w.SetLastBlockType(BlockTypeParagraph)
+	if w.options.LinkStyle == LinkStyleInline && w.references.used[label] && inlineURL(url) {
+		// every link using it now carries the URL inline
+		return
+	}
+
+	writeReferenceDef(w, label, url)
 }
 
 func formatFootnoteDef(state djot_parser.ConversionState[*Writer], next func(djot_parser.Children)) {
@@ -381,23 +547,24 @@ func formatFootnoteDef(state djot_parser.ConversionState[*Writer], next func(djo
 		w.WriteString("\n")
 	}
 
-	label := state.Node.Attributes.Get(djot_tokenizer.ReferenceKey)
+	label := w.footnoteLabel(state.Node.Attributes.Get(djot_tokenizer.ReferenceKey))
 
-	w.WriteString("[^")
-	w.WriteString(label)
-	w.WriteString("]: ")
-	w.IncreaseIndent()
+	w.PushListMarker("[^"+label+"]: ", "  ")
 
 	previousBlockType := w.GetLastBlockType()
 	w.SetLastBlockType(BlockTypeNone)
 	next(nil)
 	w.SetLastBlockType(previousBlockType)
 
-	w.DecreaseIndent()
+	if w.markerPending() {
+		w.WriteString("\n")
+	}
+
+	w.PopIndent()
 	w.SetLastBlockType(BlockTypeParagraph)
 }
 
-func formatTable(state djot_parser.ConversionState[*Writer], next func(djot_parser.Children)) {
+func formatHeading(state djot_parser.ConversionState[*Writer], next func(djot_parser.Children)) {
 	w := state.Writer
 
 	if w.NeedsBlankLine() {
@@ -405,74 +572,30 @@ func formatTable(state djot_parser.ConversionState[*Writer], next func(djot_pars
 	}
 
 	attrs := formatAttributes(state.Node.Attributes)
-	if attrs != "" {
-		w.WriteString(attrs)
-		w.WriteString("\n")
+	if w.options.HeadingAttributes != HeadingAttributesTrailing {
+		writeBlockAttributes(w, state.Node.Attributes)
 	}
 
+	levelMarker := state.Node.Attributes.Get(djot_parser.HeadingLevelKey)
+	w.WriteString(levelMarker)
+	w.WriteString(" ")
 	next(nil)
 
-	w.SetLastBlockType(BlockTypeParagraph)
-}
-
-func formatTableRow(state djot_parser.ConversionState[*Writer], next func(djot_parser.Children)) {
-	w := state.Writer
-
-	isHeader := false
-	if len(state.Node.Children) > 0 {
-		isHeader = state.Node.Children[0].Type == djot_parser.TableHeaderNode
+	if w.options.HeadingAttributes == HeadingAttributesTrailing && attrs != "" {
+		w.WriteString(" " + attrs)
 	}
 
-	w.WriteString("|")
-	next(nil)
-
 	w.WriteString("\n")
-
-	if isHeader && len(state.Node.Children) > 0 {
-		w.WriteString("|")
-
-		for range state.Node.Children {
-			w.WriteString("---|")
-		}
-
-		w.WriteString("\n")
-	}
-}
-
-func formatTableHeader(state djot_parser.ConversionState[*Writer], next func(djot_parser.Children)) {
-	w := state.Writer
-
-	w.WriteString(" ")
-	next(nil)
-	w.WriteString(" |")
-}
-
-func formatTableCell(state djot_parser.ConversionState[*Writer], next func(djot_parser.Children)) {
-	w := state.Writer
-
-	w.WriteString(" ")
-	next(nil)
-	w.WriteString(" |")
-}
-
-func formatTableCaption(_ djot_parser.ConversionState[*Writer], next func(djot_parser.Children)) {
-	next(nil)
+	w.SetLastBlockType(BlockTypeHeading)
 }
 
-func formatHeading(state djot_parser.ConversionState[*Writer], next func(djot_parser.Children)) {
-	w := state.Writer
-
-	if w.NeedsBlankLine() {
-		w.WriteString("\n")
+// writeBlockAttributes writes attrs on a line of their own, above the block
+// they belong to. In a list item whose marker is not written yet, that line
+// starts with the marker, `- {.note}`.
+func writeBlockAttributes(w *Writer, attrs tokenizer.Attributes) {
+	if formatted := formatAttributes(attrs); formatted != "" {
+		w.WriteString(formatted + "\n")
 	}
-
-	levelMarker := state.Node.Attributes.Get(djot_parser.HeadingLevelKey)
-	w.WriteString(levelMarker)
-	w.WriteString(" ")
-	next(nil)
-	w.WriteString(formatAttributes(state.Node.Attributes))
-	w.WriteString("\n")
-	w.SetLastBlockType(BlockTypeHeading)
 }
 
 var skippedAttributes = map[string]bool{
@@ -491,6 +614,10 @@ func shouldSkipAttribute(key string) bool {
 
 func hasNonClassAttributes(attrs tokenizer.Attributes) bool {
 	for _, key := range attrs.Keys {
+		if key == commentsKey {
+			return true
+		}
+
 		if shouldSkipAttribute(key) {
 			continue
 		}
@@ -525,7 +652,7 @@ func formatAttributes(attrs tokenizer.Attributes) string {
 		case "id":
 			id = "#" + val
 		default:
-			escapedVal := strings.ReplaceAll(val, `"`, `\"`)
+			escapedVal := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(val)
 			kvPairs = append(kvPairs, key+`="`+escapedVal+`"`)
 		}
 	}
@@ -539,10 +666,20 @@ func formatAttributes(attrs tokenizer.Attributes) string {
 
 	parts = append(parts, kvPairs...)
 
+	comments := attrs.Map[commentsKey]
+
 	if len(parts) == 0 {
+		if comments != "" {
+			return "{" + comments + "}"
+		}
+
 		return ""
 	}
 
+	if comments != "" {
+		parts = append(parts, comments)
+	}
+
 	return "{ " + strings.Join(parts, " ") + " }"
 }
 
@@ -598,26 +735,31 @@ var defaultRegistry = map[djot_parser.DjotNode]djot_parser.Conversion[*Writer]{
 	djot_parser.ReferenceDefNode: formatReferenceDef,
 	djot_parser.FootnoteDefNode:  formatFootnoteDef,
 
-	djot_parser.TableNode:        formatTable,
-	djot_parser.TableRowNode:     formatTableRow,
-	djot_parser.TableHeaderNode:  formatTableHeader,
-	djot_parser.TableCellNode:    formatTableCell,
-	djot_parser.TableCaptionNode: formatTableCaption,
+	djot_parser.TableNode: formatTable,
 }
 
 func Format(ast []djot_parser.TreeNode[djot_parser.DjotNode]) string {
-	writer := NewWriter()
-	ctx := djot_parser.ConversionContext[*Writer]{
-		Format:   "djot",
-		Registry: defaultRegistry,
-	}
-	ctx.ConvertDjot(writer, ast...)
-
-	return writer.String()
+	return FormatWithOptions(ast, DefaultOptions())
 }
 
 func FormatWithConfig(ast []djot_parser.TreeNode[djot_parser.DjotNode], slwConfig *slw.Config) string {
-	writer := NewWriterWithConfig(slwConfig)
+	opts := DefaultOptions()
+	opts.SLW = slwConfig
+
+	return FormatWithOptions(ast, opts)
+}
+
+func FormatWithOptions(ast []djot_parser.TreeNode[djot_parser.DjotNode], opts *Options) string {
+	writer := NewWriterWithOptions(opts)
+
+	if opts.RenumberFootnotes {
+		// numbered in source order, before definitions are moved
+		writer.footnotes = footnoteNumbers(ast)
+	}
+
+	ast = relocateDefinitions(ast, opts, writer.footnoteLabel)
+	writer.references = collectReferences(ast)
+
 	ctx := djot_parser.ConversionContext[*Writer]{
 		Format:   "djot",
 		Registry: defaultRegistry,
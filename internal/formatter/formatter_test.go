@@ -18,7 +18,7 @@ func TestFormat_AllNodeTypesSupported(t *testing.T) {
 		{"inline code", "`code`\n"},
 		{"code block", "```\ncode\n```\n"},
 		{"table", "| header |\n|---|\n| cell |\n"},
-		{"definition list", "term\n: definition\n"},
+		{"definition list", ": term\n\n  definition\n"},
 		{"blockquote", "> quote\n"},
 		{"thematic break", "***\n"},
 		{"reference", "[ref]: https://example.com\n"},
@@ -48,68 +48,73 @@ func TestFormat_SimpleParagraphAST(t *testing.T) {
 	assert.Equal(t, expected, result)
 }
 
-func TestFormat_BasicFixtures(t *testing.T) {
-	path := filepath.Join("../../testdata/formatter", "basic.txt")
-
-	fixtures, err := testutil.ReadFixtures(path)
-	if err != nil {
-		t.Fatalf("Failed to read fixtures: %v", err)
+func TestFormat_CodeFenceLongerThanContent(t *testing.T) {
+	ast := []djot_parser.TreeNode[djot_parser.DjotNode]{
+		{
+			Type: djot_parser.CodeNode,
+			Children: []djot_parser.TreeNode[djot_parser.DjotNode]{
+				{Type: djot_parser.TextNode, Text: []byte("```\n")},
+				{Type: djot_parser.TextNode, Text: []byte("  ````\n")},
+			},
+		},
 	}
 
-	for _, fixture := range fixtures {
-		t.Run(fixture.Title, func(t *testing.T) {
-			ast := djot_parser.BuildDjotAst([]byte(fixture.Input))
-			result := formatter.Format(ast)
+	assert.Equal(t, "`````\n```\n  ````\n`````\n", formatter.Format(ast))
+}
 
-			if !assert.Equal(t, fixture.Expected, result) {
-				t.Logf("Fixture: %s (line %d)", fixture.Title, fixture.LineNumber)
-				t.Logf("Input: %q", fixture.Input)
-			}
-		})
+func TestFormat_NestedDivFences(t *testing.T) {
+	paragraph := djot_parser.TreeNode[djot_parser.DjotNode]{
+		Type:     djot_parser.ParagraphNode,
+		Children: []djot_parser.TreeNode[djot_parser.DjotNode]{{Type: djot_parser.TextNode, Text: []byte("inner")}},
 	}
+	ast := []djot_parser.TreeNode[djot_parser.DjotNode]{
+		{
+			Type: djot_parser.DivNode,
+			Children: []djot_parser.TreeNode[djot_parser.DjotNode]{
+				{Type: djot_parser.DivNode, Children: []djot_parser.TreeNode[djot_parser.DjotNode]{paragraph}},
+			},
+		},
+	}
+
+	assert.Equal(t, "::::\n:::\ninner\n:::\n::::\n", formatter.Format(ast))
+}
+
+func TestFormat_BasicFixtures(t *testing.T) {
+	runFixtureFile(t, "basic.txt")
 }
 
 func TestFormat_SLWFixtures(t *testing.T) {
-	path := filepath.Join("../../testdata/formatter", "slw.txt")
+	runFixtureFile(t, "slw.txt")
+}
 
-	fixtures, err := testutil.ReadFixtures(path)
-	if err != nil {
-		t.Fatalf("Failed to read fixtures: %v", err)
-	}
+func TestFormat_InlineFixtures(t *testing.T) {
+	runFixtureFile(t, "inline.txt")
+}
 
-	for _, fixture := range fixtures {
-		t.Run(fixture.Title, func(t *testing.T) {
-			config := testutil.ConfigFromOptions(fixture.Options)
-			ast := djot_parser.BuildDjotAst([]byte(fixture.Input))
-			result := formatter.FormatWithConfig(ast, config)
+func TestFormat_TableFixtures(t *testing.T) {
+	runFixtureFile(t, "tables.txt")
+}
 
-			if !assert.Equal(t, fixture.Expected, result) {
-				t.Logf("Fixture: %s (line %d)", fixture.Title, fixture.LineNumber)
-				t.Logf("Input: %q", fixture.Input)
-			}
-		})
-	}
+func TestFormat_ListFixtures(t *testing.T) {
+	runFixtureFile(t, "lists.txt")
 }
 
-func TestFormat_InlineFixtures(t *testing.T) {
-	path := filepath.Join("../../testdata/formatter", "inline.txt")
+func TestFormat_LinkFixtures(t *testing.T) {
+	runFixtureFile(t, "links.txt")
+}
 
-	fixtures, err := testutil.ReadFixtures(path)
-	if err != nil {
-		t.Fatalf("Failed to read fixtures: %v", err)
-	}
+func TestFormat_DefinitionFixtures(t *testing.T) {
+	runFixtureFile(t, "definitions.txt")
+}
 
-	for _, fixture := range fixtures {
-		t.Run(fixture.Title, func(t *testing.T) {
-			ast := djot_parser.BuildDjotAst([]byte(fixture.Input))
-			result := formatter.Format(ast)
+func TestFormat_AttributeFixtures(t *testing.T) {
+	runFixtureFile(t, "attributes.txt")
+}
 
-			if !assert.Equal(t, fixture.Expected, result) {
-				t.Logf("Fixture: %s (line %d)", fixture.Title, fixture.LineNumber)
-				t.Logf("Input: %q", fixture.Input)
-			}
-		})
-	}
+func TestDuplicateDefinitions(t *testing.T) {
+	input := "[a]: https://example.com/a\n\n[^n]: Note.\n\n[a]: https://example.com/b\n\n[b]: https://example.com/b\n\n[^n]: Other.\n"
+
+	assert.Equal(t, []string{"[a]", "[^n]"}, formatter.DuplicateDefinitions(formatter.Parse([]byte(input))))
 }
 
 func TestFormat_Idempotency(t *testing.T) {
@@ -117,6 +122,11 @@ func TestFormat_Idempotency(t *testing.T) {
 		"basic.txt",
 		"inline.txt",
 		"slw.txt",
+		"tables.txt",
+		"lists.txt",
+		"links.txt",
+		"definitions.txt",
+		"attributes.txt",
 	}
 
 	for _, filename := range fixtureFiles {
@@ -130,11 +140,9 @@ func TestFormat_Idempotency(t *testing.T) {
 
 			for _, fixture := range fixtures {
 				t.Run(fixture.Title, func(t *testing.T) {
-					ast1 := djot_parser.BuildDjotAst([]byte(fixture.Input))
-					first := formatter.Format(ast1)
-
-					ast2 := djot_parser.BuildDjotAst([]byte(first))
-					second := formatter.Format(ast2)
+					opts := testutil.OptionsFromFixture(fixture.Options)
+					first := formatter.FormatWithOptions(formatter.Parse([]byte(fixture.Input)), opts)
+					second := formatter.FormatWithOptions(formatter.Parse([]byte(first)), opts)
 
 					if !assert.Equal(t, first, second) {
 						t.Logf("Fixture: %s (line %d)", fixture.Title, fixture.LineNumber)
@@ -145,3 +153,26 @@ func TestFormat_Idempotency(t *testing.T) {
 		})
 	}
 }
+
+func runFixtureFile(t *testing.T, filename string) {
+	t.Helper()
+
+	path := filepath.Join("../../testdata/formatter", filename)
+
+	fixtures, err := testutil.ReadFixtures(path)
+	if err != nil {
+		t.Fatalf("Failed to read fixtures: %v", err)
+	}
+
+	for _, fixture := range fixtures {
+		t.Run(fixture.Title, func(t *testing.T) {
+			opts := testutil.OptionsFromFixture(fixture.Options)
+			result := formatter.FormatWithOptions(formatter.Parse([]byte(fixture.Input)), opts)
+
+			if !assert.Equal(t, fixture.Expected, result) {
+				t.Logf("Fixture: %s (line %d)", fixture.Title, fixture.LineNumber)
+				t.Logf("Input: %q", fixture.Input)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package formatter
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sivukhin/godjot/v2/djot_parser"
+	"github.com/sivukhin/godjot/v2/djot_tokenizer"
+)
+
+// references tracks the reference definitions of a document, so links can be
+// switched between inline and reference style.
+type references struct {
+	urls  map[string]string // definition label to URL
+	used  map[string]bool   // labels some link refers to
+	added []referenceDef    // definitions generated for links made reference style
+}
+
+type referenceDef struct {
+	label string
+	url   string
+}
+
+func collectReferences(ast []djot_parser.TreeNode[djot_parser.DjotNode]) *references {
+	refs := &references{urls: map[string]string{}, used: map[string]bool{}}
+
+	walkNodes(ast, func(node *djot_parser.TreeNode[djot_parser.DjotNode]) {
+		switch node.Type {
+		case djot_parser.ReferenceDefNode:
+			label := node.Attributes.Get(djot_tokenizer.ReferenceKey)
+			if _, ok := refs.urls[label]; !ok {
+				refs.urls[label] = node.Attributes.Get(djot_parser.LinkHrefKey)
+			}
+		case djot_parser.LinkNode, djot_parser.ImageNode:
+			if label, ok := node.Attributes.TryGet(linkReferenceKey); ok {
+				refs.used[referenceLabel(*node, label)] = true
+			}
+		}
+	})
+
+	return refs
+}
+
+// referenceLabel returns the definition label a reference link points to: its
+// explicit label, or its text for the collapsed form `[text][]`.
+func referenceLabel(node djot_parser.TreeNode[djot_parser.DjotNode], label string) string {
+	if label == "" {
+		if node.Type == djot_parser.ImageNode {
+			label = node.Attributes.Get(djot_parser.ImgAltKey)
+		} else {
+			label = extractTextContent(node)
+		}
+	}
+
+	return strings.ReplaceAll(label, "\n", "")
+}
+
+// labelFor returns the label to use for url in reference style, reusing an
+// existing definition for the same URL or generating a numbered one.
+func (r *references) labelFor(url string) string {
+	var reuse string
+
+	for label, existing := range r.urls {
+		if existing == url && r.used[label] && (reuse == "" || label < reuse) {
+			reuse = label
+		}
+	}
+
+	if reuse != "" {
+		return reuse
+	}
+
+	for _, def := range r.added {
+		if def.url == url {
+			return def.label
+		}
+	}
+
+	for n := len(r.added) + 1; ; n++ {
+		label := strconv.Itoa(n)
+		if _, taken := r.urls[label]; !taken {
+			r.urls[label] = url
+			r.used[label] = true
+			r.added = append(r.added, referenceDef{label: label, url: url})
+
+			return label
+		}
+	}
+}
+
+// linkReference decides whether a link or image with the given URL is written
+// in reference style, returning the label to write between the second brackets.
+func linkReference(w *Writer, node djot_parser.TreeNode[djot_parser.DjotNode], url string) (string, bool) {
+	label, ok := node.Attributes.TryGet(linkReferenceKey)
+	if _, autolink := node.Attributes.TryGet(autolinkKey); autolink {
+		return "", false
+	}
+
+	switch w.options.LinkStyle {
+	case LinkStyleInline:
+		// a reference without a definition has no URL to inline
+		return label, ok && (url == "" || !inlineURL(url))
+	case LinkStyleReference:
+		if !ok && url != "" && node.Attributes.Get(djot_parser.RoleKey) == "" {
+			return w.references.labelFor(url), true
+		}
+	case LinkStylePreserve:
+	}
+
+	return label, ok
+}
+
+// inlineURL reports whether url can be written inside `(...)`. godjot ends the
+// URL at its first `)`, even a balanced one, and djot has no escapes there.
+func inlineURL(url string) bool {
+	return !strings.Contains(url, ")")
+}
+
+func writeReferenceDef(w *Writer, label, url string) {
+	if w.GetLastBlockType() != BlockTypeReference && w.NeedsBlankLine() {
+		w.WriteString("\n")
+	}
+
+	w.WriteString("[" + label + "]: " + url + "\n")
+	w.SetLastBlockType(BlockTypeReference)
+}
+
+// bareURL matches a URL written as plain text. Trailing punctuation is more
+// likely to end the sentence than the URL, see trimURL.
+var bareURL = regexp.MustCompile(`https?://[^\s<>]+`)
+
+// writeAutolinked writes text with each bare URL in it turned into an autolink.
+func writeAutolinked(w *Writer, text string) {
+	written := 0
+
+	for _, match := range bareURL.FindAllStringIndex(text, -1) {
+		start := match[0]
+		end := start + len(trimURL(text[start:match[1]]))
+
+		w.WriteString(text[written:start])
+		w.writeAtom("<" + text[start:end] + ">")
+		written = end
+	}
+
+	w.WriteString(text[written:])
+}
+
+// trimURL drops the punctuation ending url that is not part of it, keeping a
+// closing parenthesis that balances one inside the URL.
+func trimURL(url string) string {
+	for url != "" {
+		last := url[len(url)-1]
+
+		switch {
+		case strings.IndexByte(".,;:!?'\"", last) >= 0:
+		case last == ')' && strings.Count(url, "(") < strings.Count(url, ")"):
+		default:
+			return url
+		}
+
+		url = url[:len(url)-1]
+	}
+
+	return url
+}
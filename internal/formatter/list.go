@@ -0,0 +1,471 @@
+package formatter
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/sivukhin/godjot/v2/djot_parser"
+	"github.com/sivukhin/godjot/v2/djot_tokenizer"
+	"github.com/sivukhin/godjot/v2/tokenizer"
+)
+
+type enumeration int
+
+const (
+	enumerationDecimal enumeration = iota
+	enumerationLowerAlpha
+	enumerationUpperAlpha
+	enumerationLowerRoman
+	enumerationUpperRoman
+)
+
+// orderedStyle describes how an ordered list writes its markers, e.g. `(a)`
+// has prefix "(", lower-alpha enumeration and suffix ")".
+type orderedStyle struct {
+	prefix      string
+	suffix      string
+	enumeration enumeration
+}
+
+// listFrame carries the markers of the list being formatted, so each item
+// can pick up its own marker and the shared continuation indent.
+type listFrame struct {
+	markers []string
+	indent  string
+	next    int
+}
+
+func formatList(state djot_parser.ConversionState[*Writer], next func(djot_parser.Children)) {
+	w := state.Writer
+
+	if w.InListItem() && !w.markerPending() {
+		w.WriteString("\n")
+	} else if w.NeedsBlankLine() {
+		w.WriteString("\n")
+	}
+
+	if len(state.Node.Children) > 0 {
+		// godjot keeps the attributes written above a list on its first item
+		writeBlockAttributes(w, itemAttributes(state.Node.Type, state.Node.Children[0]))
+	}
+
+	bullet := ""
+	if state.Node.Type == djot_parser.UnorderedListNode {
+		bullet = chooseBullet(w, state.Node)
+	}
+
+	markers := listMarkers(state.Node, w.options.OrderedListNumbering, bullet)
+
+	width := 0
+	for _, marker := range markers {
+		width = max(width, len(marker))
+	}
+
+	w.pushListFrame(&listFrame{markers: markers, indent: strings.Repeat(" ", width)})
+
+	_, isSparse := state.Node.Attributes.TryGet(djot_parser.SparseListNodeKey)
+	wasSparse := w.InSparseList()
+	w.SetInSparseList(isSparse)
+	next(nil)
+	w.SetInSparseList(wasSparse)
+
+	w.popListFrame()
+	w.SetLastBlockType(BlockTypeList)
+	w.lastBullet = bullet
+}
+
+// bulletCycle is the order bullets alternate in by depth; it is also the
+// order alternatives are tried in when two lists would otherwise merge.
+var bulletCycle = []string{"-", "+", "*"}
+
+// chooseBullet picks the marker for an unordered list. djot starts a new list
+// whenever the bullet changes, so a list that directly follows another bullet
+// list must not reuse its marker or the two would merge.
+func chooseBullet(w *Writer, list djot_parser.TreeNode[djot_parser.DjotNode]) string {
+	bullet := "-"
+
+	switch w.options.BulletStyle {
+	case BulletStyleAsterisk:
+		bullet = "*"
+	case BulletStylePlus:
+		bullet = "+"
+	case BulletStyleAlternate:
+		bullet = bulletCycle[len(w.listFrames)%len(bulletCycle)]
+	case BulletStylePreserve:
+		if len(list.Children) > 0 {
+			if marker := list.Children[0].Attributes.Get(listMarkerKey); marker != "" {
+				bullet = marker
+			}
+		}
+	case BulletStyleDash:
+	}
+
+	if w.GetLastBlockType() != BlockTypeList || w.lastBullet != bullet {
+		return bullet
+	}
+
+	for _, candidate := range bulletCycle {
+		if candidate != bullet {
+			return candidate
+		}
+	}
+
+	return bullet
+}
+
+func formatListItem(state djot_parser.ConversionState[*Writer], next func(djot_parser.Children)) {
+	w := state.Writer
+
+	marker, indent, first := "- ", "  ", true
+	if frame := w.currentListFrame(); frame != nil && frame.next < len(frame.markers) {
+		marker, indent, first = frame.markers[frame.next], frame.indent, frame.next == 0
+		frame.next++
+	}
+
+	// Loose items are separated by blank lines; a trailing one would double up
+	// with the blank line the next block writes.
+	if w.InSparseList() && !first {
+		w.WriteString("\n")
+	}
+
+	w.PushListMarker(marker, indent)
+
+	wasInListItem := w.InListItem()
+	w.SetInListItem(true)
+
+	previousBlockType := w.GetLastBlockType()
+	w.SetLastBlockType(BlockTypeNone)
+
+	formatItemContent(w, state.Node.Children, next)
+
+	if w.markerPending() {
+		// empty item: still emit its marker
+		w.WriteString("\n")
+	}
+
+	w.SetLastBlockType(previousBlockType)
+	w.PopIndent()
+	w.SetInListItem(wasInListItem)
+}
+
+// formatItemContent writes the children of a list item. Tight items hold
+// their text directly instead of in a paragraph, so runs of inline content are
+// treated as a paragraph for semantic line wrapping.
+func formatItemContent(w *Writer, children djot_parser.Children, next func(djot_parser.Children)) {
+	for start := 0; start < len(children); {
+		inline := isInlineNode(children[start])
+
+		end := start + 1
+		for end < len(children) && isInlineNode(children[end]) == inline {
+			end++
+		}
+
+		run := children[start:end]
+		if inline {
+			// godjot can end an item closed by a fence with an extra line
+			// break, which would otherwise be written as a blank line
+			for len(run) > 1 && isLineEnding(run[len(run)-1]) && isLineEnding(run[len(run)-2]) {
+				run = run[:len(run)-1]
+			}
+
+			w.wrapInline(func() { next(run) })
+		} else {
+			next(run)
+		}
+
+		start = end
+	}
+}
+
+func isLineEnding(node djot_parser.TreeNode[djot_parser.DjotNode]) bool {
+	return node.Type == djot_parser.TextNode && string(node.Text) == "\n"
+}
+
+func isInlineNode(node djot_parser.TreeNode[djot_parser.DjotNode]) bool {
+	switch node.Type {
+	case djot_parser.TextNode,
+		djot_parser.EmphasisNode,
+		djot_parser.StrongNode,
+		djot_parser.HighlightedNode,
+		djot_parser.SubscriptNode,
+		djot_parser.SuperscriptNode,
+		djot_parser.InsertNode,
+		djot_parser.DeleteNode,
+		djot_parser.SymbolsNode,
+		djot_parser.VerbatimNode,
+		djot_parser.LineBreakNode,
+		djot_parser.LinkNode,
+		djot_parser.ImageNode,
+		djot_parser.SpanNode:
+		return true
+	default:
+		return false
+	}
+}
+
+// listMarkers returns the marker, including its trailing space, for every
+// item of list. bullet is only used for unordered lists.
+func listMarkers(list djot_parser.TreeNode[djot_parser.DjotNode], numbering ListNumbering, bullet string) []string {
+	markers := make([]string, 0, len(list.Children))
+
+	switch list.Type {
+	case djot_parser.TaskListNode:
+		for _, item := range list.Children {
+			if item.Attributes.Get("class") == djot_parser.CheckedTaskItemClass {
+				markers = append(markers, "- [x] ")
+			} else {
+				markers = append(markers, "- [ ] ")
+			}
+		}
+	case djot_parser.OrderedListNode:
+		style, start := detectOrderedStyle(list)
+
+		numbers := listNumbers(list, style, start, numbering)
+		if !style.enumerates(numbers) {
+			// letters run out after z, and djot reads no `aa.` marker, so the
+			// numbers written are kept, or decimal ones used if even they do not fit
+			numbers = listNumbers(list, style, start, ListNumberingPreserve)
+			if !style.enumerates(numbers) {
+				style.enumeration = enumerationDecimal
+			}
+		}
+
+		for _, number := range numbers {
+			markers = append(markers, style.prefix+formatEnumeration(number, style.enumeration)+style.suffix+" ")
+		}
+	default:
+		for range list.Children {
+			markers = append(markers, bullet+" ")
+		}
+	}
+
+	return markers
+}
+
+// listNumbers returns the number of every item of an ordered list.
+func listNumbers(list djot_parser.TreeNode[djot_parser.DjotNode], style orderedStyle, start int, numbering ListNumbering) []int {
+	numbers := make([]int, 0, len(list.Children))
+
+	for i, item := range list.Children {
+		number := start
+
+		switch numbering {
+		case ListNumberingIncrement:
+			number = start + i
+		case ListNumberingPreserve:
+			number = start + i
+			if _, value, _ := splitOrderedMarker(item.Attributes.Get(listMarkerKey)); value != "" {
+				number = parseEnumeration(value, style.enumeration)
+			}
+		case ListNumberingOne:
+		}
+
+		numbers = append(numbers, number)
+	}
+
+	return numbers
+}
+
+// enumerates reports whether every number can be written in the style's
+// enumeration: alphabetic lists only go from a to z.
+func (style orderedStyle) enumerates(numbers []int) bool {
+	if style.enumeration != enumerationLowerAlpha && style.enumeration != enumerationUpperAlpha {
+		return true
+	}
+
+	return !slices.ContainsFunc(numbers, func(number int) bool { return number < 1 || number > 26 })
+}
+
+// detectOrderedStyle works out the marker style and start number of an
+// ordered list. The source markers are preferred, since godjot reads roman
+// numerals as letters and does not record the delimiter.
+func detectOrderedStyle(list djot_parser.TreeNode[djot_parser.DjotNode]) (orderedStyle, int) {
+	style := orderedStyle{suffix: "."}
+
+	switch list.Attributes.Get("type") {
+	case "a":
+		style.enumeration = enumerationLowerAlpha
+	case "A":
+		style.enumeration = enumerationUpperAlpha
+	}
+
+	start := 1
+	if value, err := strconv.Atoi(list.Attributes.Get("start")); err == nil {
+		start = value
+	}
+
+	if len(list.Children) == 0 {
+		return style, start
+	}
+
+	prefix, value, suffix := splitOrderedMarker(list.Children[0].Attributes.Get(listMarkerKey))
+	if value == "" {
+		return style, start
+	}
+
+	style.prefix, style.suffix = prefix, suffix
+
+	if isRomanList(list) {
+		style.enumeration = enumerationLowerRoman
+		if unicode.IsUpper(rune(value[0])) {
+			style.enumeration = enumerationUpperRoman
+		}
+	}
+
+	return style, parseEnumeration(value, style.enumeration)
+}
+
+// splitOrderedMarker splits a marker such as `(iv)` into "(", "iv" and ")".
+func splitOrderedMarker(marker string) (prefix, value, suffix string) {
+	if len(marker) < 2 {
+		return "", "", ""
+	}
+
+	if strings.HasPrefix(marker, "(") {
+		prefix, marker = "(", marker[1:]
+	}
+
+	suffix = marker[len(marker)-1:]
+	if suffix != "." && suffix != ")" {
+		return "", "", ""
+	}
+
+	return prefix, marker[:len(marker)-1], suffix
+}
+
+// isRomanList reports whether the source markers read as roman numerals. A
+// lone `i` counts as roman; other single letters such as `c` or `v` only do
+// when a later marker needs more than one letter.
+func isRomanList(list djot_parser.TreeNode[djot_parser.DjotNode]) bool {
+	multiLetter := false
+
+	for i, item := range list.Children {
+		_, value, _ := splitOrderedMarker(item.Attributes.Get(listMarkerKey))
+		if value == "" || romanValue(value) == 0 {
+			return false
+		}
+
+		if i == 0 && strings.EqualFold(value, "i") || len(value) > 1 {
+			multiLetter = true
+		}
+	}
+
+	return multiLetter
+}
+
+func parseEnumeration(value string, kind enumeration) int {
+	switch kind {
+	case enumerationLowerAlpha, enumerationUpperAlpha:
+		number := 0
+		for _, char := range strings.ToLower(value) {
+			number = number*26 + int(char-'a') + 1
+		}
+
+		return number
+	case enumerationLowerRoman, enumerationUpperRoman:
+		return romanValue(value)
+	default:
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return 1
+		}
+
+		return number
+	}
+}
+
+func formatEnumeration(number int, kind enumeration) string {
+	switch kind {
+	case enumerationLowerAlpha:
+		return alphaNumeral(number)
+	case enumerationUpperAlpha:
+		return strings.ToUpper(alphaNumeral(number))
+	case enumerationLowerRoman:
+		return strings.ToLower(romanNumeral(number))
+	case enumerationUpperRoman:
+		return romanNumeral(number)
+	default:
+		return strconv.Itoa(number)
+	}
+}
+
+// alphaNumeral converts 1, 2, ..., 26 into a, b, ..., z.
+func alphaNumeral(number int) string {
+	return string(rune('a' + min(max(number, 1), 26) - 1))
+}
+
+var romanNumerals = []struct {
+	value  int
+	symbol string
+}{
+	{1000, "M"}, {900, "CM"}, {500, "D"}, {400, "CD"},
+	{100, "C"}, {90, "XC"}, {50, "L"}, {40, "XL"},
+	{10, "X"}, {9, "IX"}, {5, "V"}, {4, "IV"}, {1, "I"},
+}
+
+func romanNumeral(number int) string {
+	if number < 1 {
+		return "I"
+	}
+
+	var result strings.Builder
+
+	for _, numeral := range romanNumerals {
+		for number >= numeral.value {
+			result.WriteString(numeral.symbol)
+			number -= numeral.value
+		}
+	}
+
+	return result.String()
+}
+
+// romanValue parses a roman numeral, returning 0 when value is not one.
+func romanValue(value string) int {
+	upper := strings.ToUpper(value)
+	if upper != value && strings.ToLower(value) != value {
+		return 0
+	}
+
+	number, rest := 0, upper
+	for _, numeral := range romanNumerals {
+		for strings.HasPrefix(rest, numeral.symbol) {
+			number += numeral.value
+			rest = rest[len(numeral.symbol):]
+		}
+	}
+
+	if rest != "" || romanNumeral(number) != upper {
+		return 0
+	}
+
+	return number
+}
+
+// itemAttributes returns the attributes written for a list item, without the
+// classes godjot adds to task list items.
+func itemAttributes(list djot_parser.DjotNode, item djot_parser.TreeNode[djot_parser.DjotNode]) tokenizer.Attributes {
+	if list != djot_parser.TaskListNode {
+		return item.Attributes
+	}
+
+	var attrs tokenizer.Attributes
+
+	for _, entry := range item.Attributes.Entries() {
+		if entry.Key == djot_tokenizer.DjotAttributeClassKey {
+			entry.Value = strings.Join(slices.DeleteFunc(strings.Fields(entry.Value), func(class string) bool {
+				return class == djot_parser.CheckedTaskItemClass || class == djot_parser.UncheckedTaskItemClass
+			}), " ")
+
+			if entry.Value == "" {
+				continue
+			}
+		}
+
+		attrs.Set(entry.Key, entry.Value)
+	}
+
+	return attrs
+}
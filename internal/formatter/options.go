@@ -0,0 +1,211 @@
+package formatter
+
+import (
+	"fmt"
+
+	"github.com/KyleKing/djot-fmt/internal/slw"
+)
+
+// ListNumbering controls how ordered list items are numbered.
+type ListNumbering string
+
+const (
+	// ListNumberingOne repeats the list's start number on every item.
+	ListNumberingOne ListNumbering = "one"
+	// ListNumberingIncrement counts up from the list's start number.
+	ListNumberingIncrement ListNumbering = "increment"
+	// ListNumberingPreserve keeps the number each item was written with.
+	ListNumberingPreserve ListNumbering = "preserve"
+)
+
+// BulletStyle controls which marker unordered list items use.
+type BulletStyle string
+
+const (
+	BulletStyleDash     BulletStyle = "dash"
+	BulletStyleAsterisk BulletStyle = "asterisk"
+	BulletStylePlus     BulletStyle = "plus"
+	// BulletStyleAlternate cycles `-`, `+`, `*` with list nesting depth.
+	BulletStyleAlternate BulletStyle = "alternate"
+	// BulletStylePreserve keeps the marker each list was written with.
+	BulletStylePreserve BulletStyle = "preserve"
+)
+
+// ParagraphWrap controls what happens to the line breaks already in a paragraph.
+type ParagraphWrap string
+
+const (
+	// ParagraphWrapPreserve keeps existing line breaks and only adds new ones.
+	ParagraphWrapPreserve ParagraphWrap = "preserve"
+	// ParagraphWrapReflow joins a paragraph's lines before wrapping it again.
+	ParagraphWrapReflow ParagraphWrap = "reflow"
+	// ParagraphWrapUnwrap writes every paragraph on a single line.
+	ParagraphWrapUnwrap ParagraphWrap = "unwrap"
+)
+
+// LinkStyle controls whether links and images are written inline or by reference.
+type LinkStyle string
+
+const (
+	// LinkStylePreserve keeps each link the way it was written.
+	LinkStylePreserve LinkStyle = "preserve"
+	// LinkStyleInline writes every link with its URL in place, `[text](url)`.
+	LinkStyleInline LinkStyle = "inline"
+	// LinkStyleReference writes every link as `[text][label]`, generating
+	// labels and definitions for links that were written inline.
+	LinkStyleReference LinkStyle = "reference"
+)
+
+// DefinitionPlacement controls where reference and footnote definitions are written.
+type DefinitionPlacement string
+
+const (
+	// DefinitionPlacementPreserve keeps each definition where it was written.
+	DefinitionPlacementPreserve DefinitionPlacement = "preserve"
+	// DefinitionPlacementDocument moves every definition to the end of the document.
+	DefinitionPlacementDocument DefinitionPlacement = "document"
+	// DefinitionPlacementSection moves each definition to the end of the section,
+	// delimited by headings, that first uses it.
+	DefinitionPlacementSection DefinitionPlacement = "section"
+)
+
+// DefinitionOrder controls how definitions moved to the same place are sorted.
+// Reference definitions always come before footnotes.
+type DefinitionOrder string
+
+const (
+	// DefinitionOrderFirstUse sorts definitions by where they are first used,
+	// with unused ones last.
+	DefinitionOrderFirstUse DefinitionOrder = "first-use"
+	// DefinitionOrderAlphabetical sorts definitions by label.
+	DefinitionOrderAlphabetical DefinitionOrder = "alphabetical"
+)
+
+// HeadingAttributes controls where a heading's attributes are written.
+type HeadingAttributes string
+
+const (
+	// HeadingAttributesAbove writes them on the line above the heading, like
+	// every other block's.
+	HeadingAttributesAbove HeadingAttributes = "above"
+	// HeadingAttributesTrailing writes them at the end of the heading line,
+	// `# Heading {#id}`.
+	HeadingAttributesTrailing HeadingAttributes = "trailing"
+)
+
+// Options holds every formatting choice that is not part of semantic line wrapping.
+type Options struct {
+	SLW                  *slw.Config
+	OrderedListNumbering ListNumbering
+	BulletStyle          BulletStyle
+	ParagraphWrap        ParagraphWrap
+	LinkStyle            LinkStyle
+	DefinitionPlacement  DefinitionPlacement
+	DefinitionOrder      DefinitionOrder
+	HeadingAttributes    HeadingAttributes
+	// RenumberFootnotes numbers numeric footnote labels 1, 2, 3, ... in the
+	// order the footnotes are first referenced.
+	RenumberFootnotes bool
+	// AutolinkURLs turns bare URLs in text into autolinks, `<url>`.
+	AutolinkURLs bool
+	// NormalizeMath collapses every run of whitespace inside math to a single
+	// space.
+	NormalizeMath bool
+}
+
+func DefaultOptions() *Options {
+	return &Options{
+		SLW:                  slw.DefaultConfig(),
+		OrderedListNumbering: ListNumberingOne,
+		BulletStyle:          BulletStyleDash,
+		ParagraphWrap:        ParagraphWrapPreserve,
+		LinkStyle:            LinkStylePreserve,
+		DefinitionPlacement:  DefinitionPlacementPreserve,
+		DefinitionOrder:      DefinitionOrderFirstUse,
+		HeadingAttributes:    HeadingAttributesAbove,
+	}
+}
+
+// ParseListNumbering validates a numbering mode name. An empty name selects the default.
+func ParseListNumbering(name string) (ListNumbering, error) {
+	switch mode := ListNumbering(name); mode {
+	case "":
+		return ListNumberingOne, nil
+	case ListNumberingOne, ListNumberingIncrement, ListNumberingPreserve:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown ordered list numbering %q (want preserve, increment or one)", name)
+	}
+}
+
+// ParseBulletStyle validates a bullet style name. An empty name selects the default.
+func ParseBulletStyle(name string) (BulletStyle, error) {
+	switch style := BulletStyle(name); style {
+	case "":
+		return BulletStyleDash, nil
+	case BulletStyleDash, BulletStyleAsterisk, BulletStylePlus, BulletStyleAlternate, BulletStylePreserve:
+		return style, nil
+	default:
+		return "", fmt.Errorf("unknown bullet style %q (want dash, asterisk, plus, alternate or preserve)", name)
+	}
+}
+
+// ParseParagraphWrap validates a paragraph wrap mode name. An empty name selects the default.
+func ParseParagraphWrap(name string) (ParagraphWrap, error) {
+	switch mode := ParagraphWrap(name); mode {
+	case "":
+		return ParagraphWrapPreserve, nil
+	case ParagraphWrapPreserve, ParagraphWrapReflow, ParagraphWrapUnwrap:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown paragraph wrap %q (want preserve, reflow or unwrap)", name)
+	}
+}
+
+// ParseLinkStyle validates a link style name. An empty name selects the default.
+func ParseLinkStyle(name string) (LinkStyle, error) {
+	switch style := LinkStyle(name); style {
+	case "":
+		return LinkStylePreserve, nil
+	case LinkStylePreserve, LinkStyleInline, LinkStyleReference:
+		return style, nil
+	default:
+		return "", fmt.Errorf("unknown link style %q (want preserve, inline or reference)", name)
+	}
+}
+
+// ParseDefinitionPlacement validates a definition placement name. An empty name selects the default.
+func ParseDefinitionPlacement(name string) (DefinitionPlacement, error) {
+	switch placement := DefinitionPlacement(name); placement {
+	case "":
+		return DefinitionPlacementPreserve, nil
+	case DefinitionPlacementPreserve, DefinitionPlacementDocument, DefinitionPlacementSection:
+		return placement, nil
+	default:
+		return "", fmt.Errorf("unknown definition placement %q (want preserve, document or section)", name)
+	}
+}
+
+// ParseDefinitionOrder validates a definition order name. An empty name selects the default.
+func ParseDefinitionOrder(name string) (DefinitionOrder, error) {
+	switch order := DefinitionOrder(name); order {
+	case "":
+		return DefinitionOrderFirstUse, nil
+	case DefinitionOrderFirstUse, DefinitionOrderAlphabetical:
+		return order, nil
+	default:
+		return "", fmt.Errorf("unknown definition order %q (want first-use or alphabetical)", name)
+	}
+}
+
+// ParseHeadingAttributes validates a heading attribute placement name. An empty name selects the default.
+func ParseHeadingAttributes(name string) (HeadingAttributes, error) {
+	switch placement := HeadingAttributes(name); placement {
+	case "":
+		return HeadingAttributesAbove, nil
+	case HeadingAttributesAbove, HeadingAttributesTrailing:
+		return placement, nil
+	default:
+		return "", fmt.Errorf("unknown heading attributes placement %q (want above or trailing)", name)
+	}
+}
@@ -0,0 +1,1098 @@
+package formatter
+
+import (
+	"bytes"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sivukhin/godjot/v2/djot_parser"
+	"github.com/sivukhin/godjot/v2/djot_tokenizer"
+	"github.com/sivukhin/godjot/v2/tokenizer"
+)
+
+// Keys for source details that godjot drops while building the AST. Like
+// godjot's own internal keys they start with `$`, so they are never emitted as
+// attributes.
+const (
+	listMarkerKey = "$ListMarker"
+	codeIndentKey = "$CodeIndent"
+	// codeFenceKey holds the number of backticks in a code block's fence.
+	codeFenceKey = "$CodeFence"
+	// divFenceKey holds the number of colons in a div's fence.
+	divFenceKey = "$DivFence"
+	// tableBreakKey marks a table row that starts a new table: godjot puts
+	// tables separated by a blank line into one table node.
+	tableBreakKey = "$TableBreak"
+	// linkReferenceKey marks a reference-style link or image with the label
+	// written in its second brackets, empty for the collapsed form `[text][]`.
+	linkReferenceKey = "$LinkReference"
+	// footnoteLabelKey holds the label of a footnote reference, which godjot
+	// replaces with the footnote's number.
+	footnoteLabelKey = "$FootnoteLabel"
+	// autolinkKey marks a link written as an autolink, `<url>`, holding the
+	// text between the angle brackets.
+	autolinkKey = "$Autolink"
+)
+
+// Parse builds the djot AST for input and annotates it with the source details
+// the formatter needs to round-trip the document.
+func Parse(input []byte) []djot_parser.TreeNode[djot_parser.DjotNode] {
+	input, comments := extractComments(input)
+	body, footnotes := splitFootnotes(input)
+	body, attributes := splitAttributes(body)
+
+	ast, source := parseSource(body)
+	insertDefinitions(ast, source, footnotes, attributes)
+	annotateComments(ast, comments)
+
+	return ast
+}
+
+// parseSource builds the annotated AST of a single document.
+func parseSource(document []byte) ([]djot_parser.TreeNode[djot_parser.DjotNode], *sourceTokens) {
+	ast := djot_parser.BuildDjotAst(document)
+	source := newSourceTokens(document)
+
+	annotateListMarkers(ast, source)
+	annotateDefinitionLists(ast, source)
+	annotateCodeFences(ast, source)
+	annotateDivFences(ast, source)
+	annotateTableRows(ast, source)
+	annotateLinkReferences(ast, source)
+	annotateImageDescriptions(ast, source)
+	annotateHeadingAttributes(ast)
+	annotateAttributeParagraphs(ast, source)
+
+	return ast, source
+}
+
+// footnoteDef is a footnote definition parsed apart from the document body.
+type footnoteDef struct {
+	start int // offset of the definition in the document
+	node  djot_parser.TreeNode[djot_parser.DjotNode]
+}
+
+// splitFootnotes takes the footnote definitions out of input and parses each
+// on its own. godjot never closes a footnote definition, so every block after
+// one would end up inside it; a definition really ends at the first of its
+// blocks that is not indented. The returned body has the definitions blanked
+// out, so offsets into it still match input.
+func splitFootnotes(input []byte) ([]byte, []footnoteDef) {
+	var (
+		body      []byte
+		footnotes []footnoteDef
+	)
+
+	for _, span := range footnoteSpans(input) {
+		start, end := span[0], span[1]
+
+		if body == nil {
+			body = bytes.Clone(input)
+		}
+
+		for i := start; i < end; i++ {
+			if body[i] != '\n' {
+				body[i] = ' '
+			}
+		}
+
+		footnotes = append(footnotes, footnoteDef{start: start, node: parseFootnote(input[start:end])})
+	}
+
+	if body == nil {
+		return input, nil
+	}
+
+	return body, footnotes
+}
+
+// blockAttributes are block attributes split out of the document body.
+type blockAttributes struct {
+	start      int // offset of the attributes in the document
+	attributes tokenizer.Attributes
+	standalone bool // comments followed by a blank line, kept apart from the next block
+}
+
+// splitAttributes takes out of input the block attribute lines that directly
+// follow a nested block, such as a list. godjot reads them as part of that
+// block, where they are dropped and make a tight list loose. It also takes out
+// top-level comment lines followed by a blank line, which godjot would attach
+// to the next block. The returned body has them blanked out, so offsets into it
+// still match input.
+func splitAttributes(input []byte) ([]byte, []blockAttributes) {
+	source := newSourceTokens(input)
+	if len(source.tokens) == 0 {
+		return input, nil
+	}
+
+	topLevel := map[int]bool{}
+	for i := 1; i < source.tokens[0].JumpToPair; i += max(source.tokens[i].JumpToPair, 0) + 1 {
+		topLevel[i] = true
+	}
+
+	var (
+		body       []byte
+		attributes []blockAttributes
+	)
+
+	for i := 0; i < len(source.tokens); i++ {
+		if !source.isBlockAttribute(i) {
+			continue
+		}
+
+		first := i
+		for i < len(source.tokens) && source.isBlockAttribute(i) {
+			i++
+		}
+
+		next := i
+		for next < len(source.tokens) && source.tokens[next].JumpToPair < 0 {
+			next++
+		}
+
+		// otherwise godjot attaches the attributes to the block that follows
+		dangling := i < len(source.tokens) && source.tokens[i].JumpToPair < 0 && topLevel[next]
+		if !dangling && !topLevel[first] {
+			continue
+		}
+
+		for _, group := range source.attributeGroups(first, i) {
+			if !dangling && !group.standalone {
+				continue
+			}
+
+			if body == nil {
+				body = bytes.Clone(input)
+			}
+
+			for j := source.tokens[group.first].Start; j < source.tokens[group.last].End; j++ {
+				if body[j] != '\n' {
+					body[j] = ' '
+				}
+			}
+
+			attributes = append(attributes, group.blockAttributes)
+		}
+	}
+
+	if body == nil {
+		return input, nil
+	}
+
+	return body, attributes
+}
+
+var (
+	// footnoteMarker matches the start of a footnote definition.
+	footnoteMarker = regexp.MustCompile(`^\[\^[^\]\n]*\]:`)
+	// referenceMarker matches the start of a reference definition.
+	referenceMarker = regexp.MustCompile(`^\[[^^\]\n][^\]\n]*\]:`)
+)
+
+// footnoteSpans returns where each top-level footnote definition in document
+// starts and really ends. The blocks after the first definition are all
+// tokenized inside it, with later definitions read as paragraphs, so a
+// definition starts at a footnote marker and ends at the next block that is
+// not indented. Reference definitions are read as paragraphs there too, and
+// take in the lines after them, so a line after one starts a block as well.
+func footnoteSpans(document []byte) [][2]int {
+	tokens := djot_tokenizer.BuildDjotTokens(document)
+
+	var (
+		spans [][2]int
+		open  = -1
+	)
+
+	// block visits a block starting on the line at lineStart
+	block := func(lineStart int, footnote bool) {
+		indented := document[lineStart] == ' ' || document[lineStart] == '\t'
+
+		if open >= 0 && !indented && lineStart != open {
+			spans = append(spans, [2]int{open, lineStart})
+			open = -1
+		}
+
+		if open < 0 && (footnote || !indented && footnoteMarker.Match(document[lineStart:])) {
+			open = lineStart
+		}
+	}
+
+	for i := 1; i < len(tokens)-1; {
+		token := tokens[i]
+		if token.JumpToPair < 0 {
+			// the end of a definition stepped into
+			i++
+			continue
+		}
+
+		lineStart := bytes.LastIndexByte(document[:token.Start], '\n') + 1
+		if token.Type == djot_tokenizer.FootnoteDefBlock {
+			lineStart = token.Start
+		}
+
+		block(lineStart, token.Type == djot_tokenizer.FootnoteDefBlock)
+
+		if token.Type == djot_tokenizer.ParagraphBlock {
+			end := tokens[i+token.JumpToPair].End
+
+			// only a run of reference definitions opening the paragraph; a
+			// later line that looks like one is paragraph text
+			reference := true
+
+			for line := lineStart; ; {
+				if document[line] != ' ' && document[line] != '\t' {
+					reference = reference && referenceMarker.Match(document[line:])
+				}
+
+				next := bytes.IndexByte(document[line:end], '\n') + line + 1
+				if !reference || next <= line || next >= end {
+					break
+				}
+
+				block(next, false)
+				line = next
+			}
+		}
+
+		if token.Type == djot_tokenizer.FootnoteDefBlock {
+			// its blocks are visited one by one
+			i++
+		} else {
+			i += max(token.JumpToPair, 0) + 1
+		}
+	}
+
+	if open >= 0 {
+		spans = append(spans, [2]int{open, len(document)})
+	}
+
+	return spans
+}
+
+// parseFootnote builds the node for the single footnote definition in
+// document, without the backlink godjot adds to it.
+func parseFootnote(document []byte) djot_parser.TreeNode[djot_parser.DjotNode] {
+	ast, _ := parseSource(document)
+
+	var def *djot_parser.TreeNode[djot_parser.DjotNode]
+
+	walkNodes(ast, func(node *djot_parser.TreeNode[djot_parser.DjotNode]) {
+		if node.Type == djot_parser.FootnoteDefNode && def == nil {
+			def = node
+		}
+	})
+
+	if def == nil {
+		return djot_parser.TreeNode[djot_parser.DjotNode]{Type: djot_parser.FootnoteDefNode}
+	}
+
+	if last := len(def.Children) - 1; last >= 0 && def.Children[last].Type == djot_parser.ParagraphNode {
+		paragraph := &def.Children[last]
+		paragraph.Children = slices.DeleteFunc(paragraph.Children, func(node djot_parser.TreeNode[djot_parser.DjotNode]) bool {
+			return node.Type == djot_parser.LinkNode && node.Attributes.Get(djot_parser.RoleKey) == "doc-backlink"
+		})
+
+		if len(paragraph.Children) == 0 {
+			def.Children = def.Children[:last]
+		}
+	}
+
+	return *def
+}
+
+// sourceTokens indexes the token stream so annotations can be matched to AST
+// nodes. godjot emits AST nodes in token order, except that footnote
+// definitions are moved to an endnotes section and reference definitions are
+// dropped; footnote and skipped record where each token ends up.
+type sourceTokens struct {
+	document []byte
+	tokens   tokenizer.TokenList[djot_tokenizer.DjotToken]
+	footnote []int
+	skipped  []bool
+}
+
+func newSourceTokens(document []byte) *sourceTokens {
+	tokens := djot_tokenizer.BuildDjotTokens(document)
+	source := &sourceTokens{
+		document: document,
+		tokens:   tokens,
+		footnote: make([]int, len(tokens)),
+		skipped:  make([]bool, len(tokens)),
+	}
+
+	for i := range source.footnote {
+		source.footnote[i] = -1
+	}
+
+	footnoteCount := 0
+
+	for i := 0; i < len(tokens); i++ {
+		switch tokens[i].Type {
+		case djot_tokenizer.FootnoteDefBlock:
+			for j := i; j <= i+tokens[i].JumpToPair; j++ {
+				source.footnote[j] = footnoteCount
+			}
+
+			footnoteCount++
+			i += tokens[i].JumpToPair
+		case djot_tokenizer.ReferenceDefBlock:
+			for j := i; j <= i+tokens[i].JumpToPair; j++ {
+				source.skipped[j] = true
+			}
+
+			i += tokens[i].JumpToPair
+		}
+	}
+
+	return source
+}
+
+func (s *sourceTokens) text(i int) string {
+	return string(s.tokens[i].Bytes(s.document))
+}
+
+// astOrder sorts token indices into the order godjot emits their nodes: the
+// document body first, then each footnote definition in turn.
+func (s *sourceTokens) astOrder(indices []int) []int {
+	sort.SliceStable(indices, func(a, b int) bool {
+		return s.footnote[indices[a]] < s.footnote[indices[b]]
+	})
+
+	return indices
+}
+
+func walkNodes(nodes []djot_parser.TreeNode[djot_parser.DjotNode], visit func(*djot_parser.TreeNode[djot_parser.DjotNode])) {
+	for i := range nodes {
+		visit(&nodes[i])
+		walkNodes(nodes[i].Children, visit)
+	}
+}
+
+// openingTokens returns the tokens of the given type that open a node godjot
+// keeps, leaving out those keep rejects when it is given.
+func (s *sourceTokens) openingTokens(tokenType djot_tokenizer.DjotToken, keep func(i int) bool) []int {
+	var indices []int
+
+	for i, token := range s.tokens {
+		if token.Type == tokenType && token.JumpToPair > 0 && !s.skipped[i] && (keep == nil || keep(i)) {
+			indices = append(indices, i)
+		}
+	}
+
+	return indices
+}
+
+// matchNodes pairs the tokens with the nodes match picks out of ast, and calls
+// set for each pair. A count mismatch means godjot grouped the tokens in a way
+// we cannot follow, so nothing is set and the formatter falls back to what the
+// AST alone provides.
+func matchNodes(
+	ast []djot_parser.TreeNode[djot_parser.DjotNode],
+	source *sourceTokens,
+	tokens []int,
+	match func(node *djot_parser.TreeNode[djot_parser.DjotNode]) bool,
+	set func(node *djot_parser.TreeNode[djot_parser.DjotNode], i int),
+) {
+	var nodes []*djot_parser.TreeNode[djot_parser.DjotNode]
+
+	walkNodes(ast, func(node *djot_parser.TreeNode[djot_parser.DjotNode]) {
+		if match(node) {
+			nodes = append(nodes, node)
+		}
+	})
+
+	if len(nodes) != len(tokens) {
+		return
+	}
+
+	for k, i := range source.astOrder(tokens) {
+		set(nodes[k], i)
+	}
+}
+
+// isFootnoteWrapper reports whether node is one of the list items godjot wraps
+// footnote definitions in when it collects them into the endnotes section.
+func isFootnoteWrapper(node *djot_parser.TreeNode[djot_parser.DjotNode]) bool {
+	return node.Type == djot_parser.ListItemNode &&
+		len(node.Children) > 0 &&
+		node.Children[0].Type == djot_parser.FootnoteDefNode
+}
+
+func annotateListMarkers(ast []djot_parser.TreeNode[djot_parser.DjotNode], source *sourceTokens) {
+	// definition list items become term/definition nodes, not list items
+	markerTokens := source.openingTokens(djot_tokenizer.ListItemBlock, func(i int) bool {
+		return strings.TrimSpace(source.text(i)) != ":"
+	})
+
+	matchNodes(ast, source, markerTokens, func(node *djot_parser.TreeNode[djot_parser.DjotNode]) bool {
+		return node.Type == djot_parser.ListItemNode && !isFootnoteWrapper(node)
+	}, func(node *djot_parser.TreeNode[djot_parser.DjotNode], i int) {
+		node.Attributes.Set(listMarkerKey, strings.TrimSpace(source.text(i)))
+	})
+}
+
+// annotateDefinitionLists marks which definition lists are loose: those with
+// a blank line between two of their items. godjot marks every list whose
+// terms have a definition as loose, for the blank line after the term.
+func annotateDefinitionLists(ast []djot_parser.TreeNode[djot_parser.DjotNode], source *sourceTokens) {
+	isItem := func(i int) bool {
+		return i < len(source.tokens) && source.tokens[i].Type == djot_tokenizer.ListItemBlock &&
+			source.tokens[i].JumpToPair > 0 && strings.TrimSpace(source.text(i)) == ":"
+	}
+
+	var (
+		starts  []int
+		loose   = map[int]bool{}
+		grouped = map[int]bool{}
+	)
+
+	for i := range source.tokens {
+		if !isItem(i) || grouped[i] || source.skipped[i] {
+			continue
+		}
+
+		for item := i; isItem(item); item += source.tokens[item].JumpToPair + 1 {
+			grouped[item] = true
+			loose[i] = loose[i] || (item != i && source.blankLineBefore(item))
+		}
+
+		starts = append(starts, i)
+	}
+
+	matchNodes(ast, source, starts, func(node *djot_parser.TreeNode[djot_parser.DjotNode]) bool {
+		return node.Type == djot_parser.DefinitionListNode
+	}, func(node *djot_parser.TreeNode[djot_parser.DjotNode], i int) {
+		var attrs tokenizer.Attributes
+
+		for _, entry := range node.Attributes.Entries() {
+			if entry.Key != djot_parser.SparseListNodeKey {
+				attrs.Set(entry.Key, entry.Value)
+			}
+		}
+
+		if loose[i] {
+			attrs.Set(djot_parser.SparseListNodeKey, "true")
+		}
+
+		node.Attributes = attrs
+	})
+}
+
+// annotateImageDescriptions gives every image the nodes of its description.
+// godjot only keeps the description as plain text, in the alt attribute, so
+// the formatting inside it is parsed again from the source.
+func annotateImageDescriptions(ast []djot_parser.TreeNode[djot_parser.DjotNode], source *sourceTokens) {
+	imageTokens := source.openingTokens(djot_tokenizer.ImageSpanInline, nil)
+
+	matchNodes(ast, source, imageTokens, func(node *djot_parser.TreeNode[djot_parser.DjotNode]) bool {
+		return node.Type == djot_parser.ImageNode
+	}, func(node *djot_parser.TreeNode[djot_parser.DjotNode], i int) {
+		description := source.document[source.tokens[i].End:source.tokens[i+source.tokens[i].JumpToPair].Start]
+
+		// continuation lines carry the indentation and blockquote markers of
+		// the container
+		lines := bytes.Split(description, []byte("\n"))
+		for j := 1; j < len(lines); j++ {
+			lines[j] = bytes.TrimLeft(lines[j], " \t>")
+		}
+
+		parsed, _ := parseSource(bytes.Join(lines, []byte("\n")))
+		if len(parsed) == 1 && parsed[0].Type == djot_parser.DocumentNode && len(parsed[0].Children) == 1 &&
+			parsed[0].Children[0].Type == djot_parser.ParagraphNode {
+			node.Children = parsed[0].Children[0].Children
+		}
+	})
+}
+
+// annotateHeadingAttributes moves attributes written at the end of a heading,
+// `# Heading {#id}`, onto the heading. godjot reads them as the attributes of
+// an empty span after the heading text; unlike `[]{#id}`, that span still
+// holds an empty text node.
+func annotateHeadingAttributes(ast []djot_parser.TreeNode[djot_parser.DjotNode]) {
+	walkNodes(ast, func(node *djot_parser.TreeNode[djot_parser.DjotNode]) {
+		count := len(node.Children)
+		if node.Type != djot_parser.HeadingNode || count < 2 {
+			return
+		}
+
+		text, span := &node.Children[count-2], node.Children[count-1]
+		if span.Type != djot_parser.SpanNode || len(span.Children) != 1 ||
+			span.Children[0].Type != djot_parser.TextNode || len(span.Children[0].Text) != 0 ||
+			text.Type != djot_parser.TextNode || !bytes.HasSuffix(text.Text, []byte(" ")) {
+			return
+		}
+
+		node.Attributes.MergeWith(span.Attributes)
+		text.Text = bytes.TrimRight(text.Text, " ")
+		node.Children = node.Children[:count-1]
+	})
+}
+
+// annotateAttributeParagraphs restores the attributes of paragraphs opening
+// with an attribute line, such as a comment inside a blockquote or the
+// attributes after a list marker, `- {.note}`. godjot reads the line as inline
+// attributes with nothing to attach to, and leaves a line break, or an empty
+// paragraph when nothing follows. A tight list item holds its text directly,
+// so the text is put in a paragraph to carry the attributes.
+func annotateAttributeParagraphs(ast []djot_parser.TreeNode[djot_parser.DjotNode], source *sourceTokens) {
+	paragraphTokens := source.openingTokens(djot_tokenizer.ParagraphBlock, source.attributeLine)
+
+	matchNodes(ast, source, paragraphTokens, func(node *djot_parser.TreeNode[djot_parser.DjotNode]) bool {
+		switch node.Type {
+		case djot_parser.ParagraphNode:
+			return len(node.Children) == 0 || isLineEnding(node.Children[0])
+		case djot_parser.ListItemNode:
+			return len(node.Children) > 0 && isLineEnding(node.Children[0])
+		}
+
+		return false
+	}, func(node *djot_parser.TreeNode[djot_parser.DjotNode], i int) {
+		var attrs tokenizer.Attributes
+
+		for j := i + 1; j < i+source.tokens[i].JumpToPair && source.blank(j); j++ {
+			attrs.MergeWith(source.tokens[j].Attributes)
+		}
+
+		if len(node.Children) > 0 {
+			node.Children = node.Children[1:]
+		}
+
+		if node.Type == djot_parser.ListItemNode {
+			text := 0
+			for text < len(node.Children) && isInlineNode(node.Children[text]) {
+				text++
+			}
+
+			end := text
+			for end > 0 && isLineEnding(node.Children[end-1]) {
+				end--
+			}
+
+			paragraph := djot_parser.TreeNode[djot_parser.DjotNode]{
+				Type:     djot_parser.ParagraphNode,
+				Children: node.Children[:end:end],
+			}
+			node.Children = append([]djot_parser.TreeNode[djot_parser.DjotNode]{paragraph}, node.Children[text:]...)
+			node = &node.Children[0]
+		}
+
+		node.Attributes.MergeWith(attrs)
+	})
+}
+
+// attributeLine reports whether the paragraph opened by token i starts with
+// attributes on a line of their own.
+func (s *sourceTokens) attributeLine(i int) bool {
+	found := false
+
+	for j := i + 1; j < i+s.tokens[i].JumpToPair; j++ {
+		switch {
+		case s.tokens[j].Type == djot_tokenizer.Attribute:
+			found = true
+		case bytes.Contains(s.tokens[j].Bytes(s.document), []byte("\n")):
+			return found
+		case !s.blank(j):
+			return false
+		}
+	}
+
+	return found
+}
+
+// blank reports whether token i writes nothing but whitespace, or is an
+// attribute.
+func (s *sourceTokens) blank(i int) bool {
+	return s.tokens[i].Type == djot_tokenizer.Attribute || len(bytes.TrimSpace(s.tokens[i].Bytes(s.document))) == 0
+}
+
+// annotateCodeFences records the length of each code block's fence and how far
+// it is indented inside its container. godjot keeps that indentation on every
+// content line of a code block nested in a list item, so the formatter has to
+// strip it.
+func annotateCodeFences(ast []djot_parser.TreeNode[djot_parser.DjotNode], source *sourceTokens) {
+	fenceTokens := source.openingTokens(djot_tokenizer.CodeBlock, nil)
+
+	matchNodes(ast, source, fenceTokens, func(node *djot_parser.TreeNode[djot_parser.DjotNode]) bool {
+		return node.Type == djot_parser.CodeNode || node.Type == djot_parser.RawNode
+	}, func(node *djot_parser.TreeNode[djot_parser.DjotNode], i int) {
+		node.Attributes.Set(codeFenceKey, strconv.Itoa(source.fenceLength(i, '`')))
+
+		if indent := source.fenceIndent(i); indent > 0 {
+			node.Attributes.Set(codeIndentKey, strconv.Itoa(indent))
+		}
+	})
+}
+
+// annotateDivFences records the length of each div's fence.
+func annotateDivFences(ast []djot_parser.TreeNode[djot_parser.DjotNode], source *sourceTokens) {
+	fenceTokens := source.openingTokens(djot_tokenizer.DivBlock, nil)
+
+	matchNodes(ast, source, fenceTokens, func(node *djot_parser.TreeNode[djot_parser.DjotNode]) bool {
+		return node.Type == djot_parser.DivNode
+	}, func(node *djot_parser.TreeNode[djot_parser.DjotNode], i int) {
+		node.Attributes.Set(divFenceKey, strconv.Itoa(source.fenceLength(i, ':')))
+	})
+}
+
+// fenceLength returns how many fence characters open the block of token i.
+func (s *sourceTokens) fenceLength(i int, fence byte) int {
+	line := strings.TrimSpace(s.text(i))
+
+	return len(line) - len(strings.TrimLeft(line, string(fence)))
+}
+
+// tableSeparator matches a table's alignment row, `|:--|--:|`.
+var tableSeparator = regexp.MustCompile(`^\|(\s*:?-+:?\s*\|)+\s*$`)
+
+// annotateTableRows marks the rows that follow a blank line, where a new table
+// starts. A table's alignment row has no node of its own, so a blank line
+// before it marks the row after it.
+func annotateTableRows(ast []djot_parser.TreeNode[djot_parser.DjotNode], source *sourceTokens) {
+	var (
+		rowTokens []int
+		breaks    = map[int]bool{}
+		afterGap  bool
+	)
+
+	for _, i := range source.openingTokens(djot_tokenizer.PipeTableBlock, nil) {
+		line := source.document[source.tokens[i].Start:source.tokens[i+source.tokens[i].JumpToPair].End]
+		afterGap = afterGap || source.blankLineBefore(i)
+
+		if tableSeparator.Match(bytes.TrimSpace(line)) {
+			// godjot makes the row before the gap the header of this separator
+			afterGap = false
+
+			continue
+		}
+
+		rowTokens = append(rowTokens, i)
+		breaks[i], afterGap = afterGap, false
+	}
+
+	matchNodes(ast, source, rowTokens, func(node *djot_parser.TreeNode[djot_parser.DjotNode]) bool {
+		return node.Type == djot_parser.TableRowNode
+	}, func(node *djot_parser.TreeNode[djot_parser.DjotNode], i int) {
+		if breaks[i] {
+			node.Attributes.Set(tableBreakKey, "true")
+		}
+	})
+}
+
+// fenceIndent returns the width of whatever precedes the fence of token i on
+// its line, leaving out blockquote markers since godjot strips those from the
+// content lines too.
+func (s *sourceTokens) fenceIndent(i int) int {
+	start := s.tokens[i].Start
+	prefix := string(s.document[bytes.LastIndexByte(s.document[:start], '\n')+1 : start])
+
+	for {
+		rest, ok := strings.CutPrefix(strings.TrimLeft(prefix, " "), ">")
+		if !ok {
+			break
+		}
+
+		prefix = strings.TrimPrefix(rest, " ")
+	}
+
+	return len(prefix)
+}
+
+func annotateLinkReferences(ast []djot_parser.TreeNode[djot_parser.DjotNode], source *sourceTokens) {
+	type linkToken struct{ start, index int }
+
+	var (
+		linkTokens []linkToken
+		urlEnd     int
+	)
+
+	for i, token := range source.tokens {
+		// godjot keeps what is inside a URL, `(<http://x.com>)`, as text
+		if source.skipped[i] || token.JumpToPair <= 0 || i < urlEnd {
+			continue
+		}
+
+		switch token.Type {
+		case djot_tokenizer.LinkUrlInline, djot_tokenizer.LinkReferenceInline:
+			urlEnd = i + token.JumpToPair
+			// the node starts at the brackets holding the link text
+			if i > 0 && source.tokens[i-1].JumpToPair < 0 {
+				linkTokens = append(linkTokens, linkToken{start: i - 1 + source.tokens[i-1].JumpToPair, index: i})
+			}
+		case djot_tokenizer.AutolinkInline, djot_tokenizer.FootnoteReferenceInline:
+			linkTokens = append(linkTokens, linkToken{start: i, index: i})
+		}
+	}
+
+	// nested links, such as an image inside link text, come before their parent
+	// in the token stream but after it in the AST
+	sort.SliceStable(linkTokens, func(a, b int) bool { return linkTokens[a].start < linkTokens[b].start })
+
+	indices := make([]int, len(linkTokens))
+	for k, token := range linkTokens {
+		indices[k] = token.index
+	}
+
+	matchNodes(ast, source, indices, func(node *djot_parser.TreeNode[djot_parser.DjotNode]) bool {
+		switch node.Type {
+		case djot_parser.LinkNode:
+			return node.Attributes.Get(djot_parser.RoleKey) != "doc-backlink"
+		case djot_parser.ImageNode:
+			return true
+		}
+
+		return false
+	}, func(node *djot_parser.TreeNode[djot_parser.DjotNode], i int) {
+		closing := source.tokens[i+source.tokens[i].JumpToPair]
+		label := string(source.document[source.tokens[i].End:closing.Start])
+
+		switch source.tokens[i].Type {
+		case djot_tokenizer.LinkUrlInline:
+			// godjot keeps the indentation of a URL split across lines
+			if strings.Contains(label, "\n") {
+				key := djot_parser.LinkHrefKey
+				if node.Type == djot_parser.ImageNode {
+					key = djot_parser.ImgSrcKey
+				}
+
+				node.Attributes.Set(key, joinURL(label))
+			}
+		case djot_tokenizer.LinkReferenceInline:
+			node.Attributes.Set(linkReferenceKey, label)
+		case djot_tokenizer.FootnoteReferenceInline:
+			node.Attributes.Set(footnoteLabelKey, label)
+		case djot_tokenizer.AutolinkInline:
+			node.Attributes.Set(autolinkKey, label)
+		}
+	})
+}
+
+// insertDefinitions puts the reference definitions godjot drops from the AST,
+// and the footnote definitions split out of it, back into the document, each
+// before the top-level block that followed it in the source. A definition that
+// cannot be placed goes to the end of the document. The block attributes
+// split out of the document go on the top-level block that followed them.
+func insertDefinitions(
+	ast []djot_parser.TreeNode[djot_parser.DjotNode],
+	source *sourceTokens,
+	footnotes []footnoteDef,
+	attributes []blockAttributes,
+) {
+	if len(ast) != 1 || ast[0].Type != djot_parser.DocumentNode || len(source.tokens) == 0 {
+		return
+	}
+
+	blocks := topLevelBlocks(ast, source)
+
+	type placedDef struct {
+		start int
+		node  djot_parser.TreeNode[djot_parser.DjotNode]
+	}
+
+	var (
+		defs     []placedDef
+		topLevel = map[int]bool{}
+	)
+
+	document := source.tokens[0]
+	for i := 1; i < document.JumpToPair; i += max(source.tokens[i].JumpToPair, 0) + 1 {
+		if source.tokens[i].Type == djot_tokenizer.ReferenceDefBlock && source.tokens[i].JumpToPair > 0 {
+			topLevel[i] = true
+			defs = append(defs, placedDef{start: source.tokens[i].Start, node: source.referenceDef(i)})
+		}
+	}
+
+	for _, footnote := range footnotes {
+		defs = append(defs, placedDef{start: footnote.start, node: footnote.node})
+	}
+
+	for _, attrs := range attributes {
+		if attrs.standalone {
+			// a paragraph with attributes only is written as just them
+			defs = append(defs, placedDef{start: attrs.start, node: djot_parser.TreeNode[djot_parser.DjotNode]{
+				Type:       djot_parser.ParagraphNode,
+				Attributes: attrs.attributes,
+			}})
+		}
+	}
+
+	sort.SliceStable(defs, func(a, b int) bool { return defs[a].start < defs[b].start })
+
+	var (
+		inserts  = map[int][]djot_parser.TreeNode[djot_parser.DjotNode]{}
+		merges   = map[int]tokenizer.Attributes{}
+		unplaced []djot_parser.TreeNode[djot_parser.DjotNode]
+	)
+
+	slotAfter := func(start int) int {
+		return sort.Search(len(blocks), func(k int) bool { return source.tokens[blocks[k]].Start > start })
+	}
+
+	for _, def := range defs {
+		slot := slotAfter(def.start)
+		if slot == len(blocks) {
+			unplaced = append(unplaced, def.node)
+			continue
+		}
+
+		inserts[slot] = append(inserts[slot], def.node)
+	}
+
+	for _, attrs := range attributes {
+		if slot := slotAfter(attrs.start); slot < len(blocks) && !attrs.standalone {
+			merged := merges[slot]
+			merged.MergeWith(attrs.attributes)
+			merges[slot] = merged
+		}
+	}
+
+	slot := 0
+
+	visitTopLevel(&ast[0].Children, func(node *djot_parser.TreeNode[djot_parser.DjotNode]) ([]djot_parser.TreeNode[djot_parser.DjotNode], bool) {
+		if attrs, ok := merges[slot]; ok {
+			target := node
+			if isList(node.Type) && len(node.Children) > 0 {
+				// like godjot, keep the attributes of a list on its first item
+				target = &node.Children[0]
+			}
+
+			target.Attributes.MergeWith(attrs)
+		}
+
+		slot++
+
+		return inserts[slot-1], true
+	})
+
+	for i, token := range source.tokens {
+		if token.Type == djot_tokenizer.ReferenceDefBlock && token.JumpToPair > 0 && !topLevel[i] {
+			// nested in another block, where the AST has no place for it
+			unplaced = append(unplaced, source.referenceDef(i))
+		}
+	}
+
+	ast[0].Children = append(ast[0].Children, unplaced...)
+}
+
+// topLevelBlocks matches the top-level block tokens of the document with the
+// blocks visitTopLevel visits, and returns the token opening each block in
+// that order. Matching stops where the AST is not shaped the way we expect.
+func topLevelBlocks(ast []djot_parser.TreeNode[djot_parser.DjotNode], source *sourceTokens) []int {
+	var slots []djot_parser.TreeNode[djot_parser.DjotNode]
+
+	visitTopLevel(&ast[0].Children, func(node *djot_parser.TreeNode[djot_parser.DjotNode]) ([]djot_parser.TreeNode[djot_parser.DjotNode], bool) {
+		slots = append(slots, *node)
+		return nil, true
+	})
+
+	var blocks []int
+
+	listItems, inTable := 0, false
+
+	document := source.tokens[0]
+	for i := 1; i < document.JumpToPair; i += max(source.tokens[i].JumpToPair, 0) + 1 {
+		token := source.tokens[i]
+		if token.JumpToPair <= 0 && token.Type != djot_tokenizer.ThematicBreakToken {
+			continue
+		}
+
+		wasInTable := inTable
+		inTable = token.Type == djot_tokenizer.PipeTableBlock || token.Type == djot_tokenizer.PipeTableCaptionBlock
+
+		switch {
+		case token.Type == djot_tokenizer.ReferenceDefBlock:
+			continue
+		case token.Type == djot_tokenizer.ListItemBlock && listItems > 0:
+			listItems--
+			continue
+		case inTable && wasInTable:
+			continue
+		}
+
+		slot := len(blocks)
+		if slot >= len(slots) || !slotMatches(token.Type, slots[slot].Type) {
+			break
+		}
+
+		if token.Type == djot_tokenizer.ListItemBlock {
+			// the remaining items of the list are in the same node
+			listItems = len(slots[slot].Children) - 1
+		}
+
+		blocks = append(blocks, i)
+	}
+
+	return blocks
+}
+
+// attributeGroup is a run of block attribute lines, from token first to last.
+type attributeGroup struct {
+	blockAttributes
+
+	first, last int
+}
+
+// attributeGroups splits the block attribute tokens from first up to end into
+// groups of lines belonging together. Comments followed by a blank line stand
+// on their own.
+func (s *sourceTokens) attributeGroups(first, end int) []attributeGroup {
+	var (
+		groups []attributeGroup
+		group  = attributeGroup{first: first}
+	)
+
+	for i := first; i < end; i++ {
+		group.attributes.MergeWith(s.tokens[i].Attributes)
+
+		group.standalone = isCommentOnly(group.attributes) && s.blankLineAfter(i)
+		if group.standalone || i == end-1 {
+			group.start, group.last = s.tokens[group.first].Start, i
+			groups = append(groups, group)
+			group = attributeGroup{first: i + 1}
+		}
+	}
+
+	return groups
+}
+
+// blankLineBefore reports whether the line before the one token i starts on
+// is blank, ignoring blockquote markers.
+func (s *sourceTokens) blankLineBefore(i int) bool {
+	lineStart := bytes.LastIndexByte(s.document[:s.tokens[i].Start], '\n')
+	if lineStart < 0 {
+		return false
+	}
+
+	line := s.document[bytes.LastIndexByte(s.document[:lineStart], '\n')+1 : lineStart]
+
+	return len(bytes.Trim(line, " \t>")) == 0
+}
+
+// blankLineAfter reports whether the line after the one token i ends on is
+// blank, or the document ends there.
+func (s *sourceTokens) blankLineAfter(i int) bool {
+	end := s.tokens[i].End
+	if !bytes.HasSuffix(s.document[s.tokens[i].Start:end], []byte("\n")) {
+		if newline := bytes.IndexByte(s.document[end:], '\n'); newline >= 0 {
+			end += newline + 1
+		} else {
+			end = len(s.document)
+		}
+	}
+
+	line, _, _ := bytes.Cut(s.document[end:], []byte("\n"))
+
+	return len(bytes.TrimSpace(line)) == 0
+}
+
+// isBlockAttribute reports whether token i is an attribute on a line of its own.
+func (s *sourceTokens) isBlockAttribute(i int) bool {
+	token := s.tokens[i]
+	if token.Type != djot_tokenizer.Attribute {
+		return false
+	}
+
+	lineStart := bytes.LastIndexByte(s.document[:token.Start], '\n') + 1
+	rest, _, _ := bytes.Cut(s.document[token.End:], []byte("\n"))
+
+	if bytes.HasSuffix(s.document[token.Start:token.End], []byte("\n")) {
+		// the token ends the line
+		rest = nil
+	}
+
+	return len(bytes.TrimSpace(s.document[lineStart:token.Start])) == 0 && len(bytes.TrimSpace(rest)) == 0
+}
+
+// visitTopLevel calls visit for every top-level block in document order. The
+// nodes visit returns are inserted before the block, which is dropped unless
+// visit keeps it. Top-level blocks may sit inside the sections godjot builds
+// around headings, and inside a table node, which takes in every block that
+// follows the table. Containers are rebuilt rather than changed in place.
+func visitTopLevel(
+	container *[]djot_parser.TreeNode[djot_parser.DjotNode],
+	visit func(*djot_parser.TreeNode[djot_parser.DjotNode]) ([]djot_parser.TreeNode[djot_parser.DjotNode], bool),
+) {
+	result := make([]djot_parser.TreeNode[djot_parser.DjotNode], 0, len(*container))
+
+	for _, node := range *container {
+		switch {
+		case isTablePart(node):
+		case node.Type == djot_parser.SectionNode:
+			visitTopLevel(&node.Children, visit)
+		default:
+			before, keep := visit(&node)
+			result = append(result, before...)
+
+			if !keep {
+				continue
+			}
+
+			if node.Type == djot_parser.TableNode {
+				visitTopLevel(&node.Children, visit)
+			}
+		}
+
+		result = append(result, node)
+	}
+
+	*container = result
+}
+
+// slotMatches reports whether a top-level block token produces a node of type node.
+func slotMatches(token djot_tokenizer.DjotToken, node djot_parser.DjotNode) bool {
+	switch token {
+	case djot_tokenizer.HeadingBlock:
+		return node == djot_parser.HeadingNode
+	case djot_tokenizer.ParagraphBlock:
+		return node == djot_parser.ParagraphNode
+	case djot_tokenizer.QuoteBlock:
+		return node == djot_parser.QuoteNode
+	case djot_tokenizer.CodeBlock:
+		return node == djot_parser.CodeNode || node == djot_parser.RawNode
+	case djot_tokenizer.DivBlock:
+		return node == djot_parser.DivNode
+	case djot_tokenizer.ThematicBreakToken:
+		return node == djot_parser.ThematicBreakNode
+	case djot_tokenizer.PipeTableBlock, djot_tokenizer.PipeTableCaptionBlock:
+		return node == djot_parser.TableNode
+	case djot_tokenizer.ListItemBlock:
+		return isList(node)
+	default:
+		return true
+	}
+}
+
+// referenceDef builds the node for the reference definition opened by token i.
+func (s *sourceTokens) referenceDef(i int) djot_parser.TreeNode[djot_parser.DjotNode] {
+	token := s.tokens[i]
+	closing := s.tokens[i+token.JumpToPair]
+	url := joinURL(string(s.document[token.End:closing.Start]))
+
+	node := djot_parser.TreeNode[djot_parser.DjotNode]{Type: djot_parser.ReferenceDefNode}
+	node.Attributes.Set(djot_tokenizer.ReferenceKey, token.Attributes.Get(djot_tokenizer.ReferenceKey))
+	node.Attributes.Set(djot_parser.LinkHrefKey, url)
+
+	return node
+}
+
+// joinURL joins the lines of a URL split across lines, dropping the line
+// breaks and the whitespace around them.
+func joinURL(text string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+
+	return strings.Join(lines, "")
+}
+
+func isList(node djot_parser.DjotNode) bool {
+	return node == djot_parser.UnorderedListNode || node == djot_parser.OrderedListNode ||
+		node == djot_parser.TaskListNode || node == djot_parser.DefinitionListNode
+}
+
+func isTablePart(node djot_parser.TreeNode[djot_parser.DjotNode]) bool {
+	return node.Type == djot_parser.TableRowNode || node.Type == djot_parser.TableCaptionNode
+}
@@ -0,0 +1,229 @@
+package formatter
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/mattn/go-runewidth"
+	"github.com/sivukhin/godjot/v2/djot_parser"
+)
+
+// minColumnWidth keeps separator cells at least as wide as `---`.
+const minColumnWidth = 3
+
+// tableGrid is one table: godjot reads tables separated by a blank line as a
+// single table, so a table node can hold several.
+type tableGrid struct {
+	rows       []tableRow
+	alignments []string
+}
+
+type tableRow struct {
+	cells    []string
+	isHeader bool
+}
+
+// formatTable renders rows into a padded grid. Cells are rendered up front so
+// column widths can be measured before anything is written.
+func formatTable(state djot_parser.ConversionState[*Writer], next func(djot_parser.Children)) {
+	w := state.Writer
+
+	if w.NeedsBlankLine() {
+		w.WriteString("\n")
+	}
+
+	writeBlockAttributes(w, state.Node.Attributes)
+
+	var (
+		grids     []tableGrid
+		caption   djot_parser.Children
+		following djot_parser.Children
+	)
+
+	for i, child := range state.Node.Children {
+		switch child.Type {
+		case djot_parser.TableRowNode:
+			if _, ok := child.Attributes.TryGet(tableBreakKey); ok || len(grids) == 0 {
+				grids = append(grids, tableGrid{})
+			}
+
+			grid := &grids[len(grids)-1]
+			grid.rows = append(grid.rows, renderTableRow(w, child, next))
+			grid.alignments = mergeAlignments(grid.alignments, child)
+		case djot_parser.TableCaptionNode:
+			// godjot places the caption first, but it belongs below the rows
+			caption = child.Children
+		default:
+			// godjot never closes the table group, so blocks that follow the
+			// table (including further tables) are nested inside it
+			following = state.Node.Children[i:]
+		}
+
+		if following != nil {
+			break
+		}
+	}
+
+	for k, grid := range grids {
+		if k > 0 {
+			w.WriteString("\n")
+		}
+
+		writeTableRows(w, grid.rows, grid.alignments)
+	}
+
+	if len(caption) > 0 {
+		writeTableCaption(w, caption, next)
+	}
+
+	w.SetLastBlockType(BlockTypeParagraph)
+
+	if len(following) > 0 {
+		next(following)
+	}
+}
+
+func renderTableRow(
+	w *Writer,
+	row djot_parser.TreeNode[djot_parser.DjotNode],
+	next func(djot_parser.Children),
+) tableRow {
+	rendered := tableRow{}
+
+	for _, cell := range row.Children {
+		if cell.Type == djot_parser.TableHeaderNode {
+			rendered.isHeader = true
+		}
+
+		text := w.capture(func() {
+			if len(cell.Children) > 0 {
+				next(cell.Children)
+			}
+		})
+		rendered.cells = append(rendered.cells, text)
+	}
+
+	return rendered
+}
+
+func mergeAlignments(alignments []string, row djot_parser.TreeNode[djot_parser.DjotNode]) []string {
+	for i, cell := range row.Children {
+		if i >= len(alignments) {
+			alignments = append(alignments, djot_parser.DefaultAlignment)
+		}
+
+		if alignment := cellAlignment(cell); alignment != djot_parser.DefaultAlignment {
+			alignments[i] = alignment
+		}
+	}
+
+	return alignments
+}
+
+// cellAlignment recovers the column alignment godjot stores as an inline style.
+func cellAlignment(cell djot_parser.TreeNode[djot_parser.DjotNode]) string {
+	style := cell.Attributes.Get("style")
+	alignment := strings.TrimPrefix(style, "text-align: ")
+	alignment = strings.TrimSuffix(alignment, ";")
+
+	switch alignment {
+	case djot_parser.LeftAlignment, djot_parser.CenterAlignment, djot_parser.RightAlignment:
+		return alignment
+	default:
+		return djot_parser.DefaultAlignment
+	}
+}
+
+func writeTableRows(w *Writer, rows []tableRow, alignments []string) {
+	widths := make([]int, len(alignments))
+	for i := range widths {
+		widths[i] = minColumnWidth
+	}
+
+	for _, row := range rows {
+		for i, cell := range row.cells {
+			widths[i] = max(widths[i], runewidth.StringWidth(cell))
+		}
+	}
+
+	aligned := slices.ContainsFunc(alignments, func(alignment string) bool {
+		return alignment != djot_parser.DefaultAlignment
+	})
+
+	if aligned && len(rows) > 0 && !rows[0].isHeader {
+		// without a header, the separator row on its own sets the alignment
+		writeTableSeparator(w, widths, alignments)
+	}
+
+	for _, row := range rows {
+		w.WriteString("|")
+
+		for i, cell := range row.cells {
+			w.WriteString(" ")
+			w.WriteString(padCell(cell, widths[i], alignments[i]))
+			w.WriteString(" |")
+		}
+
+		w.WriteString("\n")
+
+		if row.isHeader {
+			writeTableSeparator(w, widths, alignments)
+		}
+	}
+}
+
+func writeTableSeparator(w *Writer, widths []int, alignments []string) {
+	w.WriteString("|")
+
+	for i, width := range widths {
+		// Separator cells span the cell padding too, since godjot only
+		// recognizes them without surrounding spaces.
+		dashes := width + 2
+
+		switch alignments[i] {
+		case djot_parser.LeftAlignment:
+			w.WriteString(":" + strings.Repeat("-", dashes-1))
+		case djot_parser.CenterAlignment:
+			w.WriteString(":" + strings.Repeat("-", dashes-2) + ":")
+		case djot_parser.RightAlignment:
+			w.WriteString(strings.Repeat("-", dashes-1) + ":")
+		default:
+			w.WriteString(strings.Repeat("-", dashes))
+		}
+
+		w.WriteString("|")
+	}
+
+	w.WriteString("\n")
+}
+
+func padCell(cell string, width int, alignment string) string {
+	padding := width - runewidth.StringWidth(cell)
+	if padding <= 0 {
+		return cell
+	}
+
+	switch alignment {
+	case djot_parser.RightAlignment:
+		return strings.Repeat(" ", padding) + cell
+	case djot_parser.CenterAlignment:
+		left := padding / 2
+		return strings.Repeat(" ", left) + cell + strings.Repeat(" ", padding-left)
+	default:
+		return cell + strings.Repeat(" ", padding)
+	}
+}
+
+// writeTableCaption emits the `^ ` caption block separated from the rows by a
+// blank line. Wrapped caption lines hang under the caption text.
+func writeTableCaption(w *Writer, caption djot_parser.Children, next func(djot_parser.Children)) {
+	w.WriteString("\n")
+	w.PushListMarker("^ ", "  ")
+	w.wrapInline(func() { next(caption) })
+
+	if !w.lineStart {
+		w.WriteString("\n")
+	}
+
+	w.PopIndent()
+}
@@ -1,9 +1,12 @@
 package formatter
 
 import (
+	"slices"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/KyleKing/djot-fmt/internal/slw"
+	"github.com/mattn/go-runewidth"
 )
 
 type BlockType int
@@ -13,102 +16,161 @@ const (
 	BlockTypeParagraph
 	BlockTypeList
 	BlockTypeHeading
+	BlockTypeReference
 )
 
+// linePrefix is the text one level of block nesting adds to each line, such
+// as a list item's indent or a blockquote's `> `. first, when set, is written
+// instead of text on the first line only (list markers).
+type linePrefix struct {
+	text  string
+	first string
+}
+
 type Writer struct {
-	output       strings.Builder
-	indentStack  []string // Stack of indent strings for nested lists
+	output       *strings.Builder
+	prefixes     []linePrefix // Stack of line prefixes for list items, blockquotes, etc.
+	emitted      int          // Number of prefixes already written on the current line
 	lastBlock    BlockType
 	inListItem   bool
 	lineStart    bool
 	slwConfig    *slw.Config
 	inParagraph  bool
-	linePrefixes []string // Stack of line prefixes for blockquotes, etc.
 	inSparseList bool
+	options      *Options
+	listFrames   []*listFrame      // Stack of lists being formatted
+	lastBullet   string            // Bullet of the most recent unordered list
+	atoms        []slw.Span        // Spans of the paragraph being wrapped that must not break
+	references   *references       // Reference definitions of the document being formatted
+	footnotes    map[string]string // New labels of renumbered footnotes
+	inLink       bool              // Writing the text of a link
 }
 
 func NewWriter() *Writer {
-	return &Writer{
-		lineStart: true,
-		slwConfig: slw.DefaultConfig(),
-	}
+	return NewWriterWithOptions(DefaultOptions())
 }
 
 func NewWriterWithConfig(slwConfig *slw.Config) *Writer {
+	opts := DefaultOptions()
+	opts.SLW = slwConfig
+
+	return NewWriterWithOptions(opts)
+}
+
+func NewWriterWithOptions(opts *Options) *Writer {
 	return &Writer{
-		lineStart: true,
-		slwConfig: slwConfig,
+		output:     &strings.Builder{},
+		lineStart:  true,
+		slwConfig:  opts.SLW,
+		options:    opts,
+		references: collectReferences(nil),
 	}
 }
 
+// WriteString writes s, starting every line with the active prefixes. Prefixes
+// are written lazily, so a prefix pushed mid-line (a blockquote opening right
+// after a list marker) still lands on the current line.
 func (w *Writer) WriteString(s string) *Writer {
-	if len(w.linePrefixes) == 0 {
-		w.writeStringDirect(s)
-		return w
-	}
+	for s != "" {
+		line, rest, hasNewline := strings.Cut(s, "\n")
 
-	w.writeStringWithPrefixes(s)
+		if line != "" {
+			w.output.WriteString(w.pendingPrefix())
+			w.output.WriteString(line)
+			w.lineStart = false
+		}
 
-	return w
-}
+		if hasNewline {
+			// an empty list item keeps the space after its marker, or `-` alone
+			// would be read as paragraph text
+			trim := w.lineStart && !slices.ContainsFunc(w.prefixes[w.emitted:], func(prefix linePrefix) bool {
+				return prefix.first != ""
+			})
 
-func (w *Writer) writeStringDirect(s string) {
-	w.output.WriteString(s)
-	w.lineStart = len(s) > 0 && s[len(s)-1] == '\n'
-}
+			prefix := w.pendingPrefix()
+			if trim {
+				// blank line: keep a bare `>` inside blockquotes, drop indentation
+				prefix = strings.TrimRight(prefix, " ")
+			}
 
-func (w *Writer) writeStringWithPrefixes(s string) {
-	prefix := strings.Join(w.linePrefixes, "")
+			w.output.WriteString(prefix)
+			w.output.WriteString("\n")
+			w.lineStart = true
+			w.emitted = 0
+		}
 
-	for i, char := range s {
-		w.applyPrefixAtLineStart(i, char, prefix)
-		w.output.WriteRune(char)
-		w.applyPrefixAfterNewline(i, char, s, prefix)
+		s = rest
 	}
 
-	w.lineStart = len(s) > 0 && s[len(s)-1] == '\n'
+	return w
 }
 
-func (w *Writer) applyPrefixAtLineStart(index int, char rune, prefix string) {
-	if index == 0 && w.lineStart {
-		if char == '\n' {
-			w.output.WriteString(strings.TrimRight(prefix, " "))
+// pendingPrefix returns the prefixes not yet written on the current line and
+// marks them as written.
+func (w *Writer) pendingPrefix() string {
+	var prefix strings.Builder
+
+	for i := w.emitted; i < len(w.prefixes); i++ {
+		if w.prefixes[i].first != "" {
+			prefix.WriteString(w.prefixes[i].first)
+			w.prefixes[i].first = ""
 		} else {
-			w.output.WriteString(prefix)
+			prefix.WriteString(w.prefixes[i].text)
 		}
 	}
+
+	w.emitted = len(w.prefixes)
+
+	return prefix.String()
 }
 
-func (w *Writer) applyPrefixAfterNewline(index int, char rune, s string, prefix string) {
-	if char == '\n' && index < len(s)-1 {
-		nextIsNewline := index+1 < len(s) && s[index+1] == '\n'
-		if nextIsNewline {
-			w.output.WriteString(strings.TrimRight(prefix, " "))
-		} else {
-			w.output.WriteString(prefix)
-		}
+// lastRune returns the last character written on the current line, or
+// startOfLine when nothing has been written on it yet.
+func (w *Writer) lastRune() rune {
+	if w.lineStart {
+		return startOfLine
 	}
+
+	last, _ := utf8.DecodeLastRuneInString(w.output.String())
+	if last == utf8.RuneError || last == '\n' {
+		return startOfLine
+	}
+
+	return last
+}
+
+func (w *Writer) pushPrefix(prefix linePrefix) *Writer {
+	w.prefixes = append(w.prefixes, prefix)
+	return w
 }
 
-func (w *Writer) WriteIndent() *Writer {
-	for _, indent := range w.indentStack {
-		w.output.WriteString(indent)
+func (w *Writer) popPrefix() *Writer {
+	if len(w.prefixes) > 0 {
+		w.prefixes = w.prefixes[:len(w.prefixes)-1]
+		w.emitted = min(w.emitted, len(w.prefixes))
 	}
 
 	return w
 }
 
 func (w *Writer) PushIndent(indent string) *Writer {
-	w.indentStack = append(w.indentStack, indent)
-	return w
+	return w.pushPrefix(linePrefix{text: indent})
 }
 
 func (w *Writer) PopIndent() *Writer {
-	if len(w.indentStack) > 0 {
-		w.indentStack = w.indentStack[:len(w.indentStack)-1]
-	}
+	return w.popPrefix()
+}
 
-	return w
+// PushListMarker starts a list item: marker begins its first line and indent
+// every line after it.
+func (w *Writer) PushListMarker(marker, indent string) *Writer {
+	return w.pushPrefix(linePrefix{text: indent, first: marker})
+}
+
+// markerPending reports whether the innermost list item has not written its
+// marker yet, i.e. nothing has been written inside it.
+func (w *Writer) markerPending() bool {
+	return len(w.prefixes) > 0 && w.prefixes[len(w.prefixes)-1].first != ""
 }
 
 func (w *Writer) IncreaseIndent() *Writer {
@@ -132,29 +194,20 @@ func (w *Writer) SetInListItem(inList bool) {
 }
 
 func (w *Writer) NeedsBlankLine() bool {
-	return w.lastBlock == BlockTypeParagraph || w.lastBlock == BlockTypeList || w.lastBlock == BlockTypeHeading
+	return w.lastBlock == BlockTypeParagraph || w.lastBlock == BlockTypeList || w.lastBlock == BlockTypeHeading ||
+		w.lastBlock == BlockTypeReference
 }
 
 func (w *Writer) InListItem() bool {
 	return w.inListItem
 }
 
-func (w *Writer) SetInParagraph(inPara bool) {
-	w.inParagraph = inPara
-}
-
-func (w *Writer) InParagraph() bool {
-	return w.inParagraph
-}
-
 func (w *Writer) PushLinePrefix(prefix string) {
-	w.linePrefixes = append(w.linePrefixes, prefix)
+	w.pushPrefix(linePrefix{text: prefix})
 }
 
 func (w *Writer) PopLinePrefix() {
-	if len(w.linePrefixes) > 0 {
-		w.linePrefixes = w.linePrefixes[:len(w.linePrefixes)-1]
-	}
+	w.popPrefix()
 }
 
 func (w *Writer) SetInSparseList(sparse bool) {
@@ -165,6 +218,126 @@ func (w *Writer) InSparseList() bool {
 	return w.inSparseList
 }
 
+func (w *Writer) pushListFrame(frame *listFrame) {
+	w.listFrames = append(w.listFrames, frame)
+}
+
+func (w *Writer) popListFrame() {
+	if len(w.listFrames) > 0 {
+		w.listFrames = w.listFrames[:len(w.listFrames)-1]
+	}
+}
+
+func (w *Writer) currentListFrame() *listFrame {
+	if len(w.listFrames) == 0 {
+		return nil
+	}
+
+	return w.listFrames[len(w.listFrames)-1]
+}
+
+// capture runs fn against a scratch buffer and returns what it wrote, so callers
+// can measure rendered content (e.g. table cells) before laying it out.
+func (w *Writer) capture(fn func()) string {
+	savedOutput, savedLineStart := w.output, w.lineStart
+	savedPrefixes, savedEmitted := w.prefixes, w.emitted
+
+	w.output = &strings.Builder{}
+	w.lineStart = false
+	w.prefixes, w.emitted = nil, 0
+
+	fn()
+
+	captured := w.output.String()
+	w.output, w.lineStart = savedOutput, savedLineStart
+	w.prefixes, w.emitted = savedPrefixes, savedEmitted
+
+	return captured
+}
+
+// wrapInline writes the inline content fn renders with semantic line wrapping
+// applied to it as a whole, so sentences are found wherever they fall relative
+// to inline markup.
+func (w *Writer) wrapInline(fn func()) {
+	mode := w.options.ParagraphWrap
+	wrap := w.slwConfig != nil && w.slwConfig.Enabled && mode != ParagraphWrapUnwrap
+
+	if w.inParagraph || !wrap && mode != ParagraphWrapReflow && mode != ParagraphWrapUnwrap {
+		fn()
+		return
+	}
+
+	w.inParagraph = true
+	text := w.capture(fn)
+	w.inParagraph = false
+
+	atoms := w.atoms
+	w.atoms = nil
+
+	if mode == ParagraphWrapReflow || mode == ParagraphWrapUnwrap {
+		text, atoms = slw.JoinLines(text, atoms)
+	}
+
+	if wrap {
+		config := *w.slwConfig
+		if config.MaxLineWidth > 0 {
+			// the line prefixes take up part of the width; always leave room for a word
+			config.MaxLineWidth = max(config.MaxLineWidth-w.prefixWidth(), 1)
+		}
+
+		text = slw.WrapParagraph(text, atoms, &config)
+	}
+
+	w.WriteString(text)
+}
+
+// prefixWidth returns the widest the active prefixes can make a line, counting
+// a list marker not yet written in place of its indent.
+func (w *Writer) prefixWidth() int {
+	width := 0
+
+	for _, prefix := range w.prefixes {
+		width += max(runewidth.StringWidth(prefix.text), runewidth.StringWidth(prefix.first))
+	}
+
+	return width
+}
+
+// atomic records what fn writes as a span wrapping must not break, such as a
+// link. Reflowing still joins the lines inside it.
+func (w *Writer) atomic(fn func()) {
+	w.recordSpan(false, fn)
+}
+
+// verbatim records what fn writes as a span wrapping must not break and whose
+// line breaks reflowing keeps, such as inline code or a hard line break.
+func (w *Writer) verbatim(fn func()) {
+	w.recordSpan(true, fn)
+}
+
+func (w *Writer) recordSpan(verbatim bool, fn func()) {
+	start := w.output.Len()
+
+	fn()
+
+	if w.inParagraph {
+		w.atoms = append(w.atoms, slw.Span{Start: start, End: w.output.Len(), Verbatim: verbatim})
+	}
+}
+
+func (w *Writer) writeAtom(s string) {
+	w.atomic(func() { w.WriteString(s) })
+}
+
+// footnoteLabel returns the label to write for the footnote written as label.
+func (w *Writer) footnoteLabel(label string) string {
+	if renumbered, ok := w.footnotes[label]; ok {
+		return renumbered
+	}
+
+	return label
+}
+
 func (w *Writer) String() string {
 	result := w.output.String()
 	return strings.TrimRight(result, "\n") + "\n"
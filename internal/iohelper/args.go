@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+
+	"github.com/KyleKing/djot-fmt/internal/formatter"
 )
 
 type Options struct {
@@ -16,17 +18,42 @@ type Options struct {
 	SlwMarkers      string
 	SlwWrap         int
 	SlwMinLine      int
+
+	OrderedListNumbering formatter.ListNumbering
+	BulletStyle          formatter.BulletStyle
+	ParagraphWrap        formatter.ParagraphWrap
+	LinkStyle            formatter.LinkStyle
+	DefinitionPlacement  formatter.DefinitionPlacement
+	DefinitionOrder      formatter.DefinitionOrder
+	HeadingAttributes    formatter.HeadingAttributes
+	RenumberFootnotes    bool
+	AutolinkURLs         bool
+	NormalizeMath        bool
 }
 
 func ParseArgs(args []string) (*Options, error) {
+	defaults := formatter.DefaultOptions()
 	opts := &Options{
 		SlwMarkers: ".!?",
 		SlwWrap:    88,
 		SlwMinLine: 40,
+
+		OrderedListNumbering: defaults.OrderedListNumbering,
+		BulletStyle:          defaults.BulletStyle,
+		ParagraphWrap:        defaults.ParagraphWrap,
+		LinkStyle:            defaults.LinkStyle,
+		DefinitionPlacement:  defaults.DefinitionPlacement,
+		DefinitionOrder:      defaults.DefinitionOrder,
+		HeadingAttributes:    defaults.HeadingAttributes,
 	}
 
 	var err error
 
+	args, err = splitFlagValues(args)
+	if err != nil {
+		return nil, err
+	}
+
 	for i := 0; i < len(args); i++ {
 		arg := args[i]
 
@@ -63,6 +90,26 @@ func parseFlag(flag string, args []string, i int, opts *Options) (int, error) {
 		return parseIntFlag(flag, args, i, &opts.SlwWrap)
 	case "--slw-min-line":
 		return parseIntFlag(flag, args, i, &opts.SlwMinLine)
+	case "--ordered-list-numbering":
+		return parseChoiceFlag(flag, args, i, &opts.OrderedListNumbering, formatter.ParseListNumbering)
+	case "--bullet-style":
+		return parseChoiceFlag(flag, args, i, &opts.BulletStyle, formatter.ParseBulletStyle)
+	case "--paragraph-wrap":
+		return parseChoiceFlag(flag, args, i, &opts.ParagraphWrap, formatter.ParseParagraphWrap)
+	case "--link-style":
+		return parseChoiceFlag(flag, args, i, &opts.LinkStyle, formatter.ParseLinkStyle)
+	case "--definition-placement":
+		return parseChoiceFlag(flag, args, i, &opts.DefinitionPlacement, formatter.ParseDefinitionPlacement)
+	case "--definition-order":
+		return parseChoiceFlag(flag, args, i, &opts.DefinitionOrder, formatter.ParseDefinitionOrder)
+	case "--heading-attributes":
+		return parseChoiceFlag(flag, args, i, &opts.HeadingAttributes, formatter.ParseHeadingAttributes)
+	case "--renumber-footnotes":
+		opts.RenumberFootnotes = true
+	case "--autolink-urls":
+		opts.AutolinkURLs = true
+	case "--normalize-math":
+		opts.NormalizeMath = true
 	default:
 		return i, fmt.Errorf("unknown flag: %s", flag)
 	}
@@ -70,6 +117,49 @@ func parseFlag(flag string, args []string, i int, opts *Options) (int, error) {
 	return i, nil
 }
 
+// longFlags lists the long flags, and whether each takes a value.
+var longFlags = map[string]bool{
+	"--write":                  false,
+	"--check":                  false,
+	"--output":                 true,
+	"--no-wrap-sentences":      false,
+	"--slw-markers":            true,
+	"--slw-wrap":               true,
+	"--slw-min-line":           true,
+	"--ordered-list-numbering": true,
+	"--bullet-style":           true,
+	"--paragraph-wrap":         true,
+	"--link-style":             true,
+	"--definition-placement":   true,
+	"--definition-order":       true,
+	"--heading-attributes":     true,
+	"--renumber-footnotes":     false,
+	"--autolink-urls":          false,
+	"--normalize-math":         false,
+}
+
+// splitFlagValues rewrites `--flag=value` into `--flag value` so both spellings
+// are accepted by the flags that take a value.
+func splitFlagValues(args []string) ([]string, error) {
+	result := make([]string, 0, len(args))
+
+	for _, arg := range args {
+		name, value, ok := strings.Cut(arg, "=")
+		takesValue, known := longFlags[name]
+
+		switch {
+		case !ok || !known:
+			result = append(result, arg)
+		case !takesValue:
+			return nil, fmt.Errorf("%s does not take a value", name)
+		default:
+			result = append(result, name, value)
+		}
+	}
+
+	return result, nil
+}
+
 func parseStringFlag(flag string, args []string, i int, target *string) (int, error) {
 	if i+1 >= len(args) {
 		return i, fmt.Errorf("%s requires a value", flag)
@@ -80,6 +170,25 @@ func parseStringFlag(flag string, args []string, i int, target *string) (int, er
 	return i + 1, nil
 }
 
+// parseChoiceFlag reads the value of a formatting option, checking it with parse.
+func parseChoiceFlag[T any](flag string, args []string, i int, target *T, parse func(string) (T, error)) (int, error) {
+	var name string
+
+	i, err := parseStringFlag(flag, args, i, &name)
+	if err != nil {
+		return i, err
+	}
+
+	value, err := parse(name)
+	if err != nil {
+		return i, fmt.Errorf("%s: %w", flag, err)
+	}
+
+	*target = value
+
+	return i, nil
+}
+
 func parseIntFlag(flag string, args []string, i int, target *int) (int, error) {
 	if i+1 >= len(args) {
 		return i, fmt.Errorf("%s requires a value", flag)
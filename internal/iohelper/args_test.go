@@ -3,6 +3,7 @@ package iohelper_test
 import (
 	"testing"
 
+	"github.com/KyleKing/djot-fmt/internal/formatter"
 	"github.com/KyleKing/djot-fmt/internal/iohelper"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -140,6 +141,152 @@ func TestParseArgs(t *testing.T) {
 				SlwMinLine: 0,
 			},
 		},
+		{
+			name: "ordered list numbering",
+			args: []string{"--ordered-list-numbering", "increment", "file.djot"},
+			want: &iohelper.Options{
+				InputFiles:           []string{"file.djot"},
+				SlwMarkers:           ".!?",
+				SlwWrap:              88,
+				SlwMinLine:           40,
+				OrderedListNumbering: "increment",
+			},
+		},
+		{
+			name: "flag value joined with equals sign",
+			args: []string{"--ordered-list-numbering=preserve", "--slw-wrap=72", "file.djot"},
+			want: &iohelper.Options{
+				InputFiles:           []string{"file.djot"},
+				SlwMarkers:           ".!?",
+				SlwWrap:              72,
+				SlwMinLine:           40,
+				OrderedListNumbering: "preserve",
+			},
+		},
+		{
+			name: "bullet style",
+			args: []string{"--bullet-style", "alternate", "file.djot"},
+			want: &iohelper.Options{
+				InputFiles:  []string{"file.djot"},
+				SlwMarkers:  ".!?",
+				SlwWrap:     88,
+				SlwMinLine:  40,
+				BulletStyle: "alternate",
+			},
+		},
+		{
+			name:    "unknown bullet style",
+			args:    []string{"--bullet-style", "circle", "file.djot"},
+			wantErr: true,
+		},
+		{
+			name: "paragraph wrap",
+			args: []string{"--paragraph-wrap", "reflow", "file.djot"},
+			want: &iohelper.Options{
+				InputFiles:    []string{"file.djot"},
+				SlwMarkers:    ".!?",
+				SlwWrap:       88,
+				SlwMinLine:    40,
+				ParagraphWrap: "reflow",
+			},
+		},
+		{
+			name: "link style",
+			args: []string{"--link-style=reference", "file.djot"},
+			want: &iohelper.Options{
+				InputFiles: []string{"file.djot"},
+				SlwMarkers: ".!?",
+				SlwWrap:    88,
+				SlwMinLine: 40,
+				LinkStyle:  "reference",
+			},
+		},
+		{
+			name: "definition placement and order",
+			args: []string{"--definition-placement=section", "--definition-order", "alphabetical", "file.djot"},
+			want: &iohelper.Options{
+				InputFiles:          []string{"file.djot"},
+				SlwMarkers:          ".!?",
+				SlwWrap:             88,
+				SlwMinLine:          40,
+				DefinitionPlacement: "section",
+				DefinitionOrder:     "alphabetical",
+			},
+		},
+		{
+			name: "renumber footnotes",
+			args: []string{"--renumber-footnotes", "file.djot"},
+			want: &iohelper.Options{
+				InputFiles:        []string{"file.djot"},
+				SlwMarkers:        ".!?",
+				SlwWrap:           88,
+				SlwMinLine:        40,
+				RenumberFootnotes: true,
+			},
+		},
+		{
+			name: "autolink urls",
+			args: []string{"--autolink-urls", "file.djot"},
+			want: &iohelper.Options{
+				InputFiles:   []string{"file.djot"},
+				SlwMarkers:   ".!?",
+				SlwWrap:      88,
+				SlwMinLine:   40,
+				AutolinkURLs: true,
+			},
+		},
+		{
+			name: "normalize math",
+			args: []string{"--normalize-math", "file.djot"},
+			want: &iohelper.Options{
+				InputFiles:    []string{"file.djot"},
+				SlwMarkers:    ".!?",
+				SlwWrap:       88,
+				SlwMinLine:    40,
+				NormalizeMath: true,
+			},
+		},
+		{
+			name: "heading attributes",
+			args: []string{"--heading-attributes", "trailing", "file.djot"},
+			want: &iohelper.Options{
+				InputFiles:        []string{"file.djot"},
+				SlwMarkers:        ".!?",
+				SlwWrap:           88,
+				SlwMinLine:        40,
+				HeadingAttributes: "trailing",
+			},
+		},
+		{
+			name:    "unknown heading attributes",
+			args:    []string{"--heading-attributes", "inline", "file.djot"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown definition placement",
+			args:    []string{"--definition-placement", "top", "file.djot"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown definition order",
+			args:    []string{"--definition-order", "random", "file.djot"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown link style",
+			args:    []string{"--link-style", "auto", "file.djot"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown paragraph wrap",
+			args:    []string{"--paragraph-wrap", "fill", "file.djot"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown ordered list numbering",
+			args:    []string{"--ordered-list-numbering", "roman", "file.djot"},
+			wantErr: true,
+		},
 		{
 			name:    "write without file",
 			args:    []string{"-w"},
@@ -160,6 +307,11 @@ func TestParseArgs(t *testing.T) {
 			args:    []string{"-o", "out.djot", "file1.djot", "file2.djot"},
 			wantErr: true,
 		},
+		{
+			name:    "value on boolean flag",
+			args:    []string{"--renumber-footnotes=false", "file.djot"},
+			wantErr: true,
+		},
 		{
 			name:    "unknown flag",
 			args:    []string{"-x"},
@@ -176,7 +328,30 @@ func TestParseArgs(t *testing.T) {
 			}
 
 			require.NoError(t, err)
-			assert.Equal(t, tt.want, got)
+			assert.Equal(t, withFormattingDefaults(tt.want), got)
 		})
 	}
 }
+
+// withFormattingDefaults fills the formatting options want leaves unset with
+// the defaults ParseArgs starts from.
+func withFormattingDefaults(want *iohelper.Options) *iohelper.Options {
+	defaults := formatter.DefaultOptions()
+
+	setDefault(&want.OrderedListNumbering, defaults.OrderedListNumbering)
+	setDefault(&want.BulletStyle, defaults.BulletStyle)
+	setDefault(&want.ParagraphWrap, defaults.ParagraphWrap)
+	setDefault(&want.LinkStyle, defaults.LinkStyle)
+	setDefault(&want.DefinitionPlacement, defaults.DefinitionPlacement)
+	setDefault(&want.DefinitionOrder, defaults.DefinitionOrder)
+	setDefault(&want.HeadingAttributes, defaults.HeadingAttributes)
+
+	return want
+}
+
+func setDefault[T comparable](field *T, value T) {
+	var zero T
+	if *field == zero {
+		*field = value
+	}
+}
@@ -11,7 +11,6 @@ import (
 	"github.com/KyleKing/djot-fmt/internal/formatter"
 	"github.com/KyleKing/djot-fmt/internal/slw"
 	"github.com/pmezard/go-difflib/difflib"
-	"github.com/sivukhin/godjot/v2/djot_parser"
 )
 
 func ProcessFile(opts *Options, inputFile string) (retErr error) {
@@ -26,17 +25,13 @@ func ProcessFile(opts *Options, inputFile string) (retErr error) {
 		return err
 	}
 
-	ast := djot_parser.BuildDjotAst(input)
+	ast := formatter.Parse(input)
 
-	slwConfig := &slw.Config{
-		Enabled:       !opts.NoWrapSentences,
-		Markers:       opts.SlwMarkers,
-		MinLineLength: opts.SlwMinLine,
-		MaxLineWidth:  opts.SlwWrap,
-		Abbreviations: slw.DefaultConfig().Abbreviations,
+	for _, label := range formatter.DuplicateDefinitions(ast) {
+		fmt.Fprintf(os.Stderr, "%s: duplicate definition %s\n", displayName(inputFile), label)
 	}
 
-	formatted := formatter.FormatWithConfig(ast, slwConfig)
+	formatted := formatter.FormatWithOptions(ast, formatterOptions(opts))
 
 	if opts.Check {
 		return checkFormatted(input, formatted, inputFile)
@@ -45,6 +40,28 @@ func ProcessFile(opts *Options, inputFile string) (retErr error) {
 	return writeOutput(formatted, opts, inputFile)
 }
 
+func formatterOptions(opts *Options) *formatter.Options {
+	return &formatter.Options{
+		SLW: &slw.Config{
+			Enabled:       !opts.NoWrapSentences,
+			Markers:       opts.SlwMarkers,
+			MinLineLength: opts.SlwMinLine,
+			MaxLineWidth:  opts.SlwWrap,
+			Abbreviations: slw.DefaultConfig().Abbreviations,
+		},
+		OrderedListNumbering: opts.OrderedListNumbering,
+		BulletStyle:          opts.BulletStyle,
+		ParagraphWrap:        opts.ParagraphWrap,
+		LinkStyle:            opts.LinkStyle,
+		DefinitionPlacement:  opts.DefinitionPlacement,
+		DefinitionOrder:      opts.DefinitionOrder,
+		HeadingAttributes:    opts.HeadingAttributes,
+		RenumberFootnotes:    opts.RenumberFootnotes,
+		AutolinkURLs:         opts.AutolinkURLs,
+		NormalizeMath:        opts.NormalizeMath,
+	}
+}
+
 func readInput(inputFile string) ([]byte, error) {
 	if inputFile == "" || inputFile == "-" {
 		data, err := io.ReadAll(os.Stdin)
@@ -98,18 +115,15 @@ func checkFormatted(original []byte, formatted string, filename string) error {
 		return nil
 	}
 
-	displayName := filename
-	if displayName == "" {
-		displayName = "stdin"
-	}
+	name := displayName(filename)
 
-	fmt.Fprintf(os.Stderr, "%s: not formatted\n", displayName)
+	fmt.Fprintf(os.Stderr, "%s: not formatted\n", name)
 
 	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
 		A:        difflib.SplitLines(string(original)),
 		B:        difflib.SplitLines(formatted),
-		FromFile: displayName,
-		ToFile:   displayName + " (formatted)",
+		FromFile: name,
+		ToFile:   name + " (formatted)",
 		Context:  3,
 	})
 
@@ -119,3 +133,11 @@ func checkFormatted(original []byte, formatted string, filename string) error {
 
 	return errors.New("file not formatted")
 }
+
+func displayName(filename string) string {
+	if filename == "" || filename == "-" {
+		return "stdin"
+	}
+
+	return filename
+}
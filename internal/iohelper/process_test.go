@@ -11,11 +11,12 @@ import (
 )
 
 func defaultTestOptions() *iohelper.Options {
-	return &iohelper.Options{
-		SlwMarkers: ".!?",
-		SlwWrap:    88,
-		SlwMinLine: 40,
+	opts, err := iohelper.ParseArgs(nil)
+	if err != nil {
+		panic(err)
 	}
+
+	return opts
 }
 
 func TestProcessFile_CodeBlockSupported(t *testing.T) {
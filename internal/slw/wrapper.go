@@ -1,8 +1,11 @@
 package slw
 
 import (
+	"regexp"
 	"strings"
 	"unicode"
+
+	"github.com/mattn/go-runewidth"
 )
 
 type Config struct {
@@ -45,80 +48,283 @@ func getDefaultAbbreviations() map[string]bool {
 	return result
 }
 
+// Span is a byte range of text that must stay on one line, such as inline
+// code or a link.
+type Span struct {
+	Start int
+	End   int
+	// Verbatim spans hold line breaks that are content, such as those in
+	// inline code or a hard line break, which JoinLines keeps.
+	Verbatim bool
+}
+
+// closingMarks may follow a sentence marker before the whitespace that ends
+// the sentence, e.g. the `_` in "_really._ Next".
+const closingMarks = "_*^~)\"'’”"
+
 func WrapText(text string, config *Config) string {
+	return WrapParagraph(text, nil, config)
+}
+
+// WrapParagraph wraps text like WrapText, but never breaks a line inside one
+// of the atomic spans.
+func WrapParagraph(text string, atoms []Span, config *Config) string {
 	if !config.Enabled || text == "" {
 		return text
 	}
 
 	var result strings.Builder
 
-	lines := strings.Split(text, "\n")
+	offset := 0
 
-	for i, line := range lines {
+	for i, line := range strings.Split(text, "\n") {
 		if i > 0 {
 			result.WriteString("\n")
 		}
 
 		if len(strings.TrimSpace(line)) == 0 {
 			result.WriteString(line)
-			continue
+		} else {
+			result.WriteString(wrapLine(line, protectedRunes(line, offset, atoms), config))
 		}
 
-		wrapped := wrapLine(line, config)
-		result.WriteString(wrapped)
+		offset += len(line) + 1
 	}
 
 	return result.String()
 }
 
-func wrapLine(line string, config *Config) string {
+// JoinLines joins the lines of a paragraph, collapsing the whitespace around
+// each line break into a single space. Line breaks inside the verbatim spans
+// are kept, as are leading and trailing ones. The spans are returned adjusted
+// to the joined text.
+func JoinLines(text string, atoms []Span) (string, []Span) {
+	var result strings.Builder
+
+	positions := make([]int, len(text)+1)
+
+	for i := 0; i < len(text); {
+		if !isJoinSpace(text[i]) || insideVerbatim(i, atoms) {
+			positions[i] = result.Len()
+			result.WriteByte(text[i])
+			i++
+
+			continue
+		}
+
+		end, hasBreak := i, false
+		for end < len(text) && isJoinSpace(text[end]) && !insideVerbatim(end, atoms) {
+			hasBreak = hasBreak || text[end] == '\n'
+			end++
+		}
+
+		keep := !hasBreak || i == 0 || end == len(text)
+
+		for j := i; j < end; j++ {
+			positions[j] = result.Len()
+
+			if keep {
+				result.WriteByte(text[j])
+			}
+		}
+
+		if !keep {
+			result.WriteByte(' ')
+		}
+
+		i = end
+	}
+
+	positions[len(text)] = result.Len()
+
+	joined := make([]Span, len(atoms))
+	for i, atom := range atoms {
+		joined[i] = Span{Start: positions[atom.Start], End: positions[atom.End], Verbatim: atom.Verbatim}
+	}
+
+	return result.String(), joined
+}
+
+func isJoinSpace(char byte) bool {
+	return char == ' ' || char == '\t' || char == '\n'
+}
+
+func insideSpan(pos int, atoms []Span) bool {
+	for _, atom := range atoms {
+		if pos >= atom.Start && pos < atom.End {
+			return true
+		}
+	}
+
+	return false
+}
+
+func insideVerbatim(pos int, atoms []Span) bool {
+	for _, atom := range atoms {
+		if atom.Verbatim && pos >= atom.Start && pos < atom.End {
+			return true
+		}
+	}
+
+	return false
+}
+
+// protectedRunes reports, for each rune of line, whether it falls inside one
+// of the atomic spans. offset is the byte offset of line within the paragraph.
+func protectedRunes(line string, offset int, atoms []Span) []bool {
+	protected := make([]bool, 0, len(line))
+
+	for pos := range line {
+		protected = append(protected, insideSpan(offset+pos, atoms))
+	}
+
+	return protected
+}
+
+func wrapLine(line string, protected []bool, config *Config) string {
+	runes := []rune(line)
+
+	var segments [][2]int
+
 	if config.MinLineLength > 0 && len(line) < config.MinLineLength {
-		return line
+		segments = append(segments, [2]int{0, len(runes)})
+	} else {
+		segments = sentenceSegments(runes, protected, config)
 	}
 
 	var result strings.Builder
 
-	runes := []rune(line)
+	for i, segment := range segments {
+		if i > 0 {
+			result.WriteString("\n")
+		}
+
+		result.WriteString(hardWrap(runes[segment[0]:segment[1]], protected[segment[0]:segment[1]], config.MaxLineWidth))
+	}
+
+	return result.String()
+}
+
+// sentenceSegments splits a line into the rune ranges of its sentences.
+func sentenceSegments(runes []rune, protected []bool, config *Config) [][2]int {
+	var segments [][2]int
+
 	currentLineStart := 0
 
 	for i := 0; i < len(runes); i++ {
-		if isSentenceBoundary(runes, i, config) {
-			segment := string(runes[currentLineStart : i+1])
-			result.WriteString(segment)
+		end := sentenceEnd(runes, protected, i, config)
+		if end < 0 {
+			continue
+		}
 
-			j := skipWhitespace(runes, i+1)
+		next := skipWhitespace(runes, end)
+		if startsBlock(runes[next:]) {
+			continue
+		}
 
-			if j < len(runes) {
-				result.WriteString("\n")
+		segments = append(segments, [2]int{currentLineStart, end})
 
-				currentLineStart = j
-				i = j - 1
-			}
-		}
+		currentLineStart = next
+		i = currentLineStart - 1
 	}
 
 	if currentLineStart < len(runes) {
-		result.WriteString(string(runes[currentLineStart:]))
+		segments = append(segments, [2]int{currentLineStart, len(runes)})
+	}
+
+	return segments
+}
+
+// hardWrap breaks a line wider than width at whitespace outside the atomic
+// spans. A word or span wider than width is left on a line of its own.
+func hardWrap(runes []rune, protected []bool, width int) string {
+	if width <= 0 {
+		return string(runes)
+	}
+
+	var result strings.Builder
+
+	start := 0
+
+	for runewidth.StringWidth(string(runes[start:])) > width {
+		breakAt := -1
+
+		for i := start + 1; i < len(runes); i++ {
+			if protected[i] || !unicode.IsSpace(runes[i]) || unicode.IsSpace(runes[i-1]) ||
+				startsBlock(runes[skipWhitespace(runes, i):]) {
+				continue
+			}
+
+			if breakAt >= 0 && runewidth.StringWidth(string(runes[start:i])) > width {
+				break
+			}
+
+			breakAt = i
+		}
+
+		if breakAt < 0 {
+			break
+		}
+
+		result.WriteString(string(runes[start:breakAt]))
+		result.WriteString("\n")
+
+		start = skipWhitespace(runes, breakAt)
 	}
 
+	result.WriteString(string(runes[start:]))
+
 	return result.String()
 }
 
-func isSentenceBoundary(runes []rune, i int, config *Config) bool {
-	if i >= len(runes) {
-		return false
+// sentenceEnd returns the index just past the sentence ending with the marker
+// at i, including any closing markup, or -1 when no sentence ends there.
+func sentenceEnd(runes []rune, protected []bool, i int, config *Config) int {
+	if protected[i] || !strings.ContainsRune(config.Markers, runes[i]) {
+		return -1
 	}
 
-	char := runes[i]
-	if !strings.ContainsRune(config.Markers, char) {
-		return false
+	end := i + 1
+	for end < len(runes) && !protected[end] && strings.ContainsRune(closingMarks, runes[end]) {
+		end++
 	}
 
-	if i+1 >= len(runes) || !unicode.IsSpace(runes[i+1]) {
-		return false
+	if end >= len(runes) || protected[end] || !unicode.IsSpace(runes[end]) {
+		return -1
 	}
 
-	return !isAbbreviation(runes, i, config.Abbreviations)
+	if isAbbreviation(runes, i, config.Abbreviations) {
+		return -1
+	}
+
+	return end
+}
+
+// enumerator matches ordered list numbers: decimal, a single letter or roman.
+const enumerator = `([0-9]+|[a-zA-Z]|[ivxlcdm]+|[IVXLCDM]+)`
+
+var (
+	// blockMarker matches list, blockquote and definition markers, heading
+	// markers and ordered list markers such as `1.`, `(a)` or `iv)`.
+	blockMarker = regexp.MustCompile(`^([-+*>:]|#+|` + enumerator + `[.)]|\(` + enumerator + `\))(\s|$)`)
+	// blockOpener matches fences, table rows, block attributes and reference
+	// or footnote definitions, which start a block whatever follows them.
+	blockOpener   = regexp.MustCompile("^(\\||\\{|```|~~~|:::|\\[[^\\]]*\\]:)")
+	thematicBreak = regexp.MustCompile(`^(([-*])\s*){3,}$`)
+)
+
+// startsBlock reports whether a line beginning with runes would be read as the
+// start of a block, e.g. a list item or heading, rather than paragraph text.
+func startsBlock(runes []rune) bool {
+	line := string(runes)
+
+	return blockMarker.MatchString(line) || blockOpener.MatchString(line) || thematicBreak.MatchString(line)
+}
+
+// StartsBlock reports whether a line beginning with line would be read as the
+// start of a block rather than as paragraph text.
+func StartsBlock(line string) bool {
+	return startsBlock([]rune(line))
 }
 
 func skipWhitespace(runes []rune, pos int) int {
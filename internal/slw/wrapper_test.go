@@ -46,3 +46,24 @@ func TestFixtures(t *testing.T) {
 		}
 	}
 }
+
+func TestWrapParagraph_Atoms(t *testing.T) {
+	config := slw.DefaultConfig()
+	config.MinLineLength = 0
+
+	text := "Run `a. b` now. Done."
+	atoms := []slw.Span{{Start: 4, End: 10}}
+
+	assert.Equal(t, "Run `a. b` now.\nDone.", slw.WrapParagraph(text, atoms, config))
+	assert.Equal(t, "Run `a.\nb` now.\nDone.", slw.WrapText(text, config))
+}
+
+func TestJoinLines(t *testing.T) {
+	text := "one  \ntwo `a\nb` [c\nd](x)\n"
+	atoms := []slw.Span{{Start: 10, End: 15, Verbatim: true}, {Start: 16, End: 24}}
+
+	joined, joinedAtoms := slw.JoinLines(text, atoms)
+
+	assert.Equal(t, "one two `a\nb` [c d](x)\n", joined)
+	assert.Equal(t, []slw.Span{{Start: 8, End: 13, Verbatim: true}, {Start: 14, End: 22}}, joinedAtoms)
+}
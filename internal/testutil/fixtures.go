@@ -7,6 +7,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/KyleKing/djot-fmt/internal/formatter"
 	"github.com/KyleKing/djot-fmt/internal/slw"
 )
 
@@ -153,3 +154,50 @@ func ConfigFromOptions(options map[string]string) *slw.Config {
 
 	return config
 }
+
+func OptionsFromFixture(options map[string]string) *formatter.Options {
+	opts := formatter.DefaultOptions()
+	opts.SLW = ConfigFromOptions(options)
+
+	if val, ok := options["ordered-list-numbering"]; ok {
+		opts.OrderedListNumbering = formatter.ListNumbering(val)
+	}
+
+	if val, ok := options["bullet-style"]; ok {
+		opts.BulletStyle = formatter.BulletStyle(val)
+	}
+
+	if val, ok := options["paragraph-wrap"]; ok {
+		opts.ParagraphWrap = formatter.ParagraphWrap(val)
+	}
+
+	if val, ok := options["link-style"]; ok {
+		opts.LinkStyle = formatter.LinkStyle(val)
+	}
+
+	if val, ok := options["definition-placement"]; ok {
+		opts.DefinitionPlacement = formatter.DefinitionPlacement(val)
+	}
+
+	if val, ok := options["definition-order"]; ok {
+		opts.DefinitionOrder = formatter.DefinitionOrder(val)
+	}
+
+	if val, ok := options["heading-attributes"]; ok {
+		opts.HeadingAttributes = formatter.HeadingAttributes(val)
+	}
+
+	if val, ok := options["renumber-footnotes"]; ok && val == "true" {
+		opts.RenumberFootnotes = true
+	}
+
+	if val, ok := options["autolink-urls"]; ok && val == "true" {
+		opts.AutolinkURLs = true
+	}
+
+	if val, ok := options["normalize-math"]; ok && val == "true" {
+		opts.NormalizeMath = true
+	}
+
+	return opts
+}
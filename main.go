@@ -89,6 +89,27 @@ SLW (Semantic Line Wrap) Options:
   --slw-wrap INTEGER       Maximum line width for wrapping (default: 88, set to 0 to disable)
   --slw-min-line INTEGER   Minimum line length before wrapping (default: 40, set to 0 for aggressive mode)
 
+Formatting Options:
+  --ordered-list-numbering MODE  Ordered list numbers: one (repeat the start number), increment,
+                                 or preserve (keep source numbers) (default: one)
+  --bullet-style STYLE           Bullet list markers: dash, asterisk, plus, alternate (by nesting depth),
+                                 or preserve (default: dash)
+  --paragraph-wrap MODE          Existing paragraph line breaks: preserve, reflow (join lines, then wrap),
+                                 or unwrap (one line per paragraph) (default: preserve)
+  --link-style STYLE             Links and images: preserve, inline ([text](url)), or reference
+                                 ([text][label] with generated labels) (default: preserve)
+  --definition-placement MODE    Reference and footnote definitions: preserve, document (move to the end),
+                                 or section (move to the end of the section first using them)
+                                 (default: preserve)
+  --definition-order ORDER       Moved definitions: first-use or alphabetical (default: first-use)
+  --heading-attributes PLACEMENT Heading attributes: above (on their own line) or trailing
+                                 (# Heading {#id}) (default: above)
+  --renumber-footnotes           Renumber numeric footnote labels in order of first reference
+  --autolink-urls                Turn bare URLs in text into autolinks (<https://example.com>)
+  --normalize-math               Collapse whitespace runs inside math to single spaces
+
+  Flags that take a value also accept --flag=value.
+
 Examples:
   # Format stdin to stdout with SLW enabled (default)
   cat file.djot | djot-fmt
@@ -111,6 +132,9 @@ Examples:
   # Aggressive SLW mode (always wrap after sentences)
   djot-fmt --slw-min-line 0 file.djot
 
+  # Number ordered lists 1, 2, 3, ...
+  djot-fmt --ordered-list-numbering=increment file.djot
+
 Focus:
   This tool formats djot files with the following features:
   - List formatting (indentation, spacing, etc.)